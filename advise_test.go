@@ -0,0 +1,47 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestAdvise(t *testing.T) {
+	f, err := ioutil.TempFile("", "advise-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	const size = 1 << 20
+	if _, err = f.Write(make([]byte, size)); err != nil {
+		t.Fatal(10, err)
+	}
+
+	if err = Fadvise(f, 0, 0, POSIX_FADV_NORMAL); err != nil {
+		t.Fatal(20, err)
+	}
+
+	if err = WriteBehind(f, 0, 0); err != nil {
+		t.Fatal(30, err)
+	}
+
+	if err = DropCache(f, 0, 0); err != nil {
+		t.Fatal(40, err)
+	}
+
+	if err = Readahead(f, 0, size); err != nil {
+		t.Fatal(50, err)
+	}
+
+	// The portable version, including a range beyond EOF.
+	if err = readRange(f, size/2, size); err != nil {
+		t.Fatal(60, err)
+	}
+}
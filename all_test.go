@@ -5,10 +5,14 @@
 package fileutil
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestTempFile(t *testing.T) {
@@ -37,3 +41,332 @@ func TestTempFile(t *testing.T) {
 		t.Fatal(base)
 	}
 }
+
+func TestMFileWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "cfg")
+	if err = ioutil.WriteFile(name, []byte("a"), 0600); err != nil {
+		t.Fatal(10, err)
+	}
+
+	m, err := NewMFile(name, os.O_RDONLY, 0, 0)
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	defer m.Close()
+
+	c := make(chan string, 10)
+	m.SetHandler(func(f *os.File) error {
+		b := make([]byte, 16)
+		n, _ := f.ReadAt(b, 0)
+		c <- string(b[:n])
+		return nil
+	})
+	switch err = m.Watch(); err {
+	case nil:
+	case ErrUnsupported:
+		t.Skip(err)
+	default:
+		t.Fatal(30, err)
+	}
+
+	defer m.Unwatch()
+
+	wait := func(e string) {
+		for {
+			select {
+			case g := <-c:
+				if g == e {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal(40, e)
+			}
+		}
+	}
+
+	if err = ioutil.WriteFile(name, []byte("b"), 0600); err != nil {
+		t.Fatal(50, err)
+	}
+
+	wait("b")
+
+	// Atomic replace.
+	tmp := filepath.Join(dir, "cfg.tmp")
+	if err = ioutil.WriteFile(tmp, []byte("c"), 0600); err != nil {
+		t.Fatal(60, err)
+	}
+
+	if err = os.Rename(tmp, name); err != nil {
+		t.Fatal(70, err)
+	}
+
+	wait("c")
+
+	// Modification of the replacement.
+	if err = ioutil.WriteFile(name, []byte("d"), 0600); err != nil {
+		t.Fatal(80, err)
+	}
+
+	wait("d")
+	f, err := m.File()
+	if err != nil {
+		t.Fatal(90, err)
+	}
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil || string(b) != "d" {
+		t.Fatal(100, string(b), err)
+	}
+
+	if err = m.Unwatch(); err != nil {
+		t.Fatal(110, err)
+	}
+}
+
+func TestMFileCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "cfg")
+	if err = ioutil.WriteFile(name, []byte("a"), 0600); err != nil {
+		t.Fatal(10, err)
+	}
+
+	m, err := NewMFile(name, os.O_RDONLY, 0, 0)
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	defer m.Close()
+
+	read := func(f *os.File) string {
+		b := make([]byte, 16)
+		n, _ := f.ReadAt(b, 0)
+		return string(b[:n])
+	}
+
+	var log []string
+	m.SetHandler(func(f *os.File) error {
+		log = append(log, read(f))
+		return nil
+	})
+	var old *os.File
+	m.SetReopenHandler(func(o, n *os.File) error {
+		old = o
+		log = append(log, read(o)+">"+read(n))
+		return nil
+	})
+	m.SetCheck(MFileCheckPath | MFileCheckHash)
+	check := func(e string) {
+		if _, err := m.File(); err != nil {
+			t.Fatal(30, err)
+		}
+
+		if g := strings.Join(log, ","); g != e {
+			t.Fatalf("%q %q", g, e)
+		}
+	}
+
+	check("")
+
+	// Touch only.
+	tm := time.Now().Add(time.Hour)
+	if err = os.Chtimes(name, tm, tm); err != nil {
+		t.Fatal(40, err)
+	}
+
+	check("")
+
+	if err = ioutil.WriteFile(name, []byte("bb"), 0600); err != nil {
+		t.Fatal(50, err)
+	}
+
+	check("bb")
+
+	// Atomic replace.
+	tmp := filepath.Join(dir, "cfg.tmp")
+	if err = ioutil.WriteFile(tmp, []byte("ccc"), 0600); err != nil {
+		t.Fatal(60, err)
+	}
+
+	if err = os.Rename(tmp, name); err != nil {
+		t.Fatal(70, err)
+	}
+
+	check("bb,bb>ccc")
+	if _, err = old.Stat(); err == nil {
+		t.Fatal(80, "old file not closed")
+	}
+
+	// Replace with the same content.
+	if err = ioutil.WriteFile(tmp, []byte("ccc"), 0600); err != nil {
+		t.Fatal(90, err)
+	}
+
+	if err = os.Rename(tmp, name); err != nil {
+		t.Fatal(100, err)
+	}
+
+	check("bb,bb>ccc")
+	if err = ioutil.WriteFile(name, []byte("dddd"), 0600); err != nil {
+		t.Fatal(110, err)
+	}
+
+	check("bb,bb>ccc,dddd")
+}
+
+func TestGoMFileSubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "cfg")
+	if err = ioutil.WriteFile(name, []byte("a"), 0600); err != nil {
+		t.Fatal(10, err)
+	}
+
+	m, err := NewGoMFile(name, os.O_RDONLY, 0, int64(time.Millisecond))
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	defer m.Close()
+
+	read := func(f *os.File) string {
+		b := make([]byte, 16)
+		n, _ := f.ReadAt(b, 0)
+		return string(b[:n])
+	}
+	errBad := errors.New("bad")
+	m.SetHandler(func(f *os.File) error {
+		if read(f) == "bad" {
+			return errBad
+		}
+
+		return nil
+	})
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	c1 := m.Subscribe(ctx1)
+	c2 := m.Subscribe(context.Background())
+	next := func(c <-chan MFileEvent) MFileEvent {
+		select {
+		case ev := <-c:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal(30)
+		}
+		panic("unreachable")
+	}
+
+	if err = ioutil.WriteFile(name, []byte("bb"), 0600); err != nil {
+		t.Fatal(40, err)
+	}
+
+	// WriteFile truncates the file first, so the poll may see the empty file
+	// and send an event for it before the one for the new content.
+	for _, c := range []<-chan MFileEvent{c1, c2} {
+		for {
+			ev := next(c)
+			if ev.Err != nil {
+				t.Fatal(50, ev)
+			}
+
+			if read(ev.File) == "bb" {
+				break
+			}
+		}
+	}
+
+	// Events sent before the cancellation may be still buffered, but c1 must
+	// get closed.
+	cancel1()
+	for range c1 {
+	}
+
+	if err = ioutil.WriteFile(name, []byte("bad"), 0600); err != nil {
+		t.Fatal(70, err)
+	}
+
+	for {
+		ev := next(c2)
+		if ev.Err == errBad {
+			break
+		}
+
+		if ev.Err != nil {
+			t.Fatal(80, ev)
+		}
+	}
+
+	// The handler error is not returned by File.
+	if _, err = m.File(); err != nil {
+		t.Fatal(90, err)
+	}
+
+	if err = m.Close(); err != nil {
+		t.Fatal(100, err)
+	}
+
+	for ev := range c2 {
+		t.Fatal(110, ev)
+	}
+
+	if _, ok := <-m.Subscribe(context.Background()); ok {
+		t.Fatal(120)
+	}
+}
+
+func TestMFileClose(t *testing.T) {
+	f, err := ioutil.TempFile("", "mfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+	f.Close()
+
+	m, err := NewGoMFile(f.Name(), os.O_RDONLY, 0, 0)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	file, err := m.File()
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	if err = m.Close(); err != nil {
+		t.Fatal(30, err)
+	}
+
+	if _, err = file.Stat(); err == nil {
+		t.Fatal(40)
+	}
+
+	if _, err = m.File(); err != ErrClosed {
+		t.Fatal(50, err)
+	}
+
+	if err = m.Watch(); err != ErrClosed {
+		t.Fatal(60, err)
+	}
+
+	if err = m.Close(); err != ErrClosed {
+		t.Fatal(70, err)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func testAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "state")
+	if err = ioutil.WriteFile(name, []byte("old"), 0600); err != nil {
+		t.Fatal(10, err)
+	}
+
+	check := func(e string) {
+		b, err := ioutil.ReadFile(name)
+		if err != nil || string(b) != e {
+			t.Fatal(20, string(b), e, err)
+		}
+
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil || len(fis) != 1 {
+			t.Fatal(30, len(fis), err)
+		}
+	}
+
+	w, err := CreateAtomic(name, 0640)
+	if err != nil {
+		t.Fatal(40, err)
+	}
+
+	defer w.Abort()
+
+	if _, err = w.Write([]byte("new")); err != nil {
+		t.Fatal(50, err)
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil || string(b) != "old" {
+		t.Fatal(60, string(b), err)
+	}
+
+	if err = w.Commit(); err != nil {
+		t.Fatal(70, err)
+	}
+
+	check("new")
+	if fi, err := os.Stat(name); err != nil || runtime.GOOS != "windows" && fi.Mode().Perm() != 0640 {
+		t.Fatal(80, fi.Mode(), err)
+	}
+
+	if err = w.Commit(); err != ErrClosed {
+		t.Fatal(90, err)
+	}
+
+	if w, err = CreateAtomic(name, 0600); err != nil {
+		t.Fatal(100, err)
+	}
+
+	if _, err = w.Write([]byte("aborted")); err != nil {
+		t.Fatal(110, err)
+	}
+
+	if err = w.Abort(); err != nil {
+		t.Fatal(120, err)
+	}
+
+	check("new")
+	if err = w.Commit(); err != ErrClosed {
+		t.Fatal(130, err)
+	}
+
+	// The umask applies like to any other newly created file.
+	if err = os.Remove(name); err != nil {
+		t.Fatal(140, err)
+	}
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(150, err)
+	}
+
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		t.Fatal(160, err)
+	}
+
+	if w, err = CreateAtomic(name, 0666); err != nil {
+		t.Fatal(170, err)
+	}
+
+	if err = w.Commit(); err != nil {
+		t.Fatal(180, err)
+	}
+
+	fi2, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(190, err)
+	}
+
+	if g, e := fi2.Mode(), fi.Mode(); g != e {
+		t.Fatal(200, g, e)
+	}
+}
+
+func TestAtomicWriter(t *testing.T) {
+	testAtomic(t)
+
+	// Force TempFile.
+	save := anonTemp
+	defer func() { anonTemp = save }()
+
+	anonTemp = func(string, os.FileMode) (*os.File, error) { return nil, ErrUnsupported }
+	testAtomic(t)
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fileutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func holes(t *testing.T, f *os.File) (n int) {
+	x, err := Extents(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range x {
+		if v.Hole {
+			n++
+		}
+	}
+	return
+}
+
+func TestCopyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	src, dst := dir+"/src", dir+"/dst"
+	file, err := os.Create(src)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	defer file.Close()
+
+	const size = 1 << 20
+	buf := make([]byte, 1<<18)
+	for i := range buf {
+		buf[i] = byte(i%251 + 1)
+	}
+	for _, off := range []int64{0, 1 << 19} {
+		if _, err = file.WriteAt(buf, off); err != nil {
+			t.Fatal(20, err)
+		}
+	}
+	if err = file.Truncate(size); err != nil {
+		t.Fatal(30, err)
+	}
+
+	if err = CopyFile(dst, src); err != nil {
+		t.Fatal(40, err)
+	}
+
+	g, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(50, err)
+	}
+
+	e, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(60, err)
+	}
+
+	if len(g) != size || !bytes.Equal(g, e) {
+		t.Fatal(70, len(g), len(e))
+	}
+
+	c, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(80, err)
+	}
+
+	defer c.Close()
+
+	if holes(t, file) != 0 && holes(t, c) == 0 {
+		t.Fatal(90)
+	}
+
+	// Copy over a larger dst.
+	buf = make([]byte, 2*size)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	if err = ioutil.WriteFile(dst, buf, 0600); err != nil {
+		t.Fatal(100, err)
+	}
+
+	d, err := os.OpenFile(dst, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(110, err)
+	}
+
+	defer d.Close()
+
+	n, err := Copy(d, file)
+	if err != nil || n != size {
+		t.Fatal(120, n, err)
+	}
+
+	if g, err = ioutil.ReadFile(dst); err != nil {
+		t.Fatal(130, err)
+	}
+
+	if !bytes.Equal(g, e) {
+		t.Fatal(140, len(g), len(e))
+	}
+
+	// Copy onto itself, also via a hard link.
+	link := dir + "/link"
+	if err = os.Link(src, link); err != nil {
+		t.Fatal(150, err)
+	}
+
+	for _, name := range []string{src, link} {
+		if err = CopyFile(name, src); err != ErrSameFile {
+			t.Fatal(160, name, err)
+		}
+
+		if g, err = ioutil.ReadFile(src); err != nil || !bytes.Equal(g, e) {
+			t.Fatal(170, name, len(g), err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !arm
+
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestFiemapExtents(t *testing.T) {
+	file, err := ioutil.TempFile("", "fiemap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	const size = 1 << 20
+	if _, err = file.WriteAt(make([]byte, 1<<16), 1<<18); err != nil {
+		t.Fatal(10, err)
+	}
+
+	if err = file.Truncate(size); err != nil {
+		t.Fatal(20, err)
+	}
+
+	x, err := fiemapExtents(file)
+	switch {
+	case err == ErrUnsupported:
+		t.Skip("FIEMAP not supported")
+	case err != nil:
+		t.Fatal(30, err)
+	}
+
+	checkExtents(t, x, size)
+	if g, e := x, []Extent{{0, 1 << 18, true}, {1 << 18, 1 << 16, false}, {1<<18 + 1<<16, size - 1<<18 - 1<<16, true}}; !reflect.DeepEqual(g, e) {
+		t.Fatal(40, g, e)
+	}
+
+	s, err := seekExtents(file, 3, 4, syscall.ENXIO)
+	if err != nil {
+		t.Fatal(50, err)
+	}
+
+	if !reflect.DeepEqual(s, x) {
+		t.Fatal(60, s, x)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fileutil
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// checkExtents verifies that x covers a file of size and that adjacent
+// extents alternate between data and holes.
+func checkExtents(t *testing.T, x []Extent, size int64) {
+	off := int64(0)
+	for i, v := range x {
+		if v.Off != off || v.Len <= 0 {
+			t.Fatal(10, i, v, off)
+		}
+
+		if i != 0 && v.Hole == x[i-1].Hole {
+			t.Fatal(20, i, x[i-1], v)
+		}
+
+		off += v.Len
+	}
+	if off != size {
+		t.Fatal(30, off, size)
+	}
+}
+
+func TestExtents(t *testing.T) {
+	file, err := ioutil.TempFile("", "extents-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	x, err := Extents(file)
+	if err != nil {
+		t.Fatal(40, err)
+	}
+
+	if len(x) != 0 {
+		t.Fatal(50, x)
+	}
+
+	const size = 1 << 20
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = 0xa5
+	}
+	if _, err = file.Write(buf); err != nil {
+		t.Fatal(60, err)
+	}
+
+	if err = file.Sync(); err != nil {
+		t.Fatal(70, err)
+	}
+
+	pos, err := file.Seek(1234, io.SeekStart)
+	if err != nil {
+		t.Fatal(80, err)
+	}
+
+	if x, err = Extents(file); err != nil {
+		t.Fatal(90, err)
+	}
+
+	checkExtents(t, x, size)
+	if x[0].Hole {
+		t.Fatal(100, x)
+	}
+
+	if g, err := file.Seek(0, io.SeekCurrent); err != nil || g != pos {
+		t.Fatal(110, g, pos, err)
+	}
+
+	const off, n = 1 << 18, 1 << 18
+	switch err = PunchHole(file, off, n); {
+	case err == ErrUnsupported:
+		t.Skip("punching holes not supported")
+	case err != nil:
+		t.Fatal(120, err)
+	}
+
+	if x, err = Extents(file); err != nil {
+		t.Fatal(130, err)
+	}
+
+	checkExtents(t, x, size)
+	if !hasPunchHole || len(x) == 1 { // No SEEK_DATA/SEEK_HOLE support.
+		return
+	}
+
+	for _, v := range x {
+		if v.Hole && v.Off <= off && v.Off+v.Len >= off+n {
+			return
+		}
+	}
+	t.Fatal(140, x)
+}
@@ -11,11 +11,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"testing"
 	"time"
@@ -32,6 +34,7 @@ var (
 	devFlag        = flag.Bool("dev", false, "enable dev tests")
 	dropFlag       = flag.Bool("drop", false, "drop system file cache for some of the dev tests before measurement")
 	fadviseFlag    = flag.Bool("fadvise", false, "hint kernel about random file access")
+	flttFlag       = flag.Uint("fltt", 0, "free lists table type of the stores created by some of the tests")
 	nFlag          = flag.Int("n", 1, "parameter for some of the dev tests")
 	probeFlag      = flag.Bool("probe", false, "report store probe statistics")
 	optGo          = flag.Int("go", 3, "GOMAXPROCS")
@@ -108,7 +111,7 @@ func fopen(fn string) (f *File, err error) {
 			return
 		}
 		advise = func(off int64, len int, write bool) {
-			if err = fileutil.Fadvise(file, off, off+int64(len), fileutil.POSIX_FADV_DONTNEED); err != nil {
+			if err = fileutil.Fadvise(file, off, int64(len), fileutil.POSIX_FADV_DONTNEED); err != nil {
 				log.Fatal("advisor advise err", err)
 			}
 		}
@@ -145,7 +148,7 @@ func fcreate(fn string) (f *File, err error) {
 			return
 		}
 		advise = func(off int64, len int, write bool) {
-			if err = fileutil.Fadvise(file, off, off+int64(len), fileutil.POSIX_FADV_DONTNEED); err != nil {
+			if err = fileutil.Fadvise(file, off, int64(len), fileutil.POSIX_FADV_DONTNEED); err != nil {
 				log.Fatal("advisor advise err", err)
 			}
 		}
@@ -165,7 +168,7 @@ func fcreate(fn string) (f *File, err error) {
 			store = storage.NewProbe(store, prob)
 		}
 	}
-	f, err = New(newBalancedAcid(store))
+	f, err = NewWithOptions(newBalancedAcid(store), &Options{FLTT: byte(*flttFlag)})
 	return
 }
 
@@ -243,6 +246,10 @@ func (f *File) audit() (usedblocks, totalblocks int64, err error) {
 			switch n := int(buf[0])<<8 + int(buf[1]); {
 			default:
 				panic(fmt.Errorf("@%#x used long, illegal content length %#x < 0xee(238)", fp, n))
+			case n == 0:
+				if last != 0 {
+					panic(fmt.Errorf("@%#x extent, last @%#x: %#x != 0", fp, fp+size<<4-1, last))
+				}
 			case n >= 0xee && n <= 0xf0f0:
 				if last >= 0xfe {
 					panic(fmt.Errorf("@%#x used long, last @%#x: %#x > 0xfe", fp, fp+size<<4-1, last))
@@ -436,8 +443,8 @@ func TestCreate(t *testing.T) {
 	}
 
 	x := b[:16]
-	if !bytes.Equal(x, hdr) {
-		t.Fatalf("\n% x\n% x", x, hdr)
+	if h := header(byte(*flttFlag)); !bytes.Equal(x, h) {
+		t.Fatalf("\n% x\n% x", x, h)
 	}
 
 	x = b[16:32]
@@ -887,7 +894,7 @@ func testFreeIsolated(t *testing.T, b []byte) {
 		t.Fatal(rep)
 	}
 
-	if x := rep[0]; x.size != rqAtoms || x.head != handle {
+	if x := rep[0]; x.size != f.class(rqAtoms) || x.head != handle {
 		t.Fatal(x)
 	}
 
@@ -936,7 +943,7 @@ func testFreeIsolated(t *testing.T, b []byte) {
 		t.Fatal(rep)
 	}
 
-	if x := rep[0]; x.size != rqAtoms || x.head != handle {
+	if x := rep[0]; x.size != f.class(rqAtoms) || x.head != handle {
 		t.Fatal(x)
 	}
 
@@ -3103,3 +3110,1055 @@ func TestMix(t *testing.T) {
 	dt = float64(time.Now().Sub(t0)) / 1e9
 	t.Logf("read time C %.3g", dt)
 }
+
+// failingStore fails WriteAt after fail successful writes, fail < 0 disables
+// the failure.
+type failingStore struct {
+	storage.Accessor
+	fail int
+}
+
+func (s *failingStore) WriteAt(b []byte, off int64) (n int, err error) {
+	if s.fail == 0 {
+		return -1, errors.New("injected write failure")
+	}
+
+	s.fail--
+	return s.Accessor.WriteAt(b, off)
+}
+
+func (s *failingStore) Rollback() error {
+	return s.Accessor.(storage.Rollbacker).Rollback()
+}
+
+func image(t *testing.T, f *File) []byte {
+	fi, err := f.f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, fi.Size())
+	if n, err := f.f.ReadAt(b, 0); n != len(b) {
+		t.Fatal(n, err)
+	}
+
+	return b
+}
+
+func TestRollback(t *testing.T) {
+	dir, name := temp()
+	defer os.RemoveAll(dir)
+
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem, err := storage.NewMem(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &failingStore{mem, -1}
+	f, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	b := make([]byte, 61680)
+	var ha []int64
+	for i := 0; i < 10; i++ {
+		ha = append(ha, alloc(f, content(b, int64(i))))
+	}
+	free(f, ha[3])
+	free(f, ha[5])
+	img, atoms, freetab := image(t, f), f.atoms, f.freetab
+
+	for fail := 0; ; fail++ {
+		store.fail = fail
+		err := storage.Mutate(store, func() (err error) {
+			defer func() {
+				if e := recover(); e != nil {
+					if _, ok := e.(*EWrite); !ok {
+						t.Fatal(fail, e)
+					}
+
+					err = e.(error)
+				}
+			}()
+
+			h := realloc(f, ha[4], content(b, 100), true)
+			free(f, ha[6])
+			realloc(f, h, nil, true)
+			return
+		})
+		if err == nil {
+			break
+		}
+
+		if g, e := image(t, f), img; !bytes.Equal(g, e) {
+			t.Fatal(fail, len(g), len(e))
+		}
+
+		store.fail = -1
+		if err := f.mutate(func() error { return nil }); err != nil {
+			t.Fatal(fail, err)
+		}
+
+		if f.atoms != atoms || f.freetab != freetab {
+			t.Fatal(fail, f.atoms, atoms)
+		}
+
+		if _, _, err := f.audit(); err != nil {
+			t.Fatal(fail, err)
+		}
+	}
+
+	if _, _, err := f.audit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A damaged free lists table fails the reload and the update.
+	store.fail = -1
+	fb := make([]byte, 1)
+	if _, err := store.ReadAt(fb, 2<<4); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.WriteAt([]byte{0xff}, 2<<4); err != nil {
+		t.Fatal(err)
+	}
+
+	f.stale = true
+	if err := f.mutate(func() error { return nil }); err == nil {
+		t.Fatal("reload of a damaged free lists table succeeded")
+	} else if _, ok := err.(*ECorrupted); !ok {
+		t.Fatal(err)
+	}
+
+	if !f.stale {
+		t.Fatal("failed reload cleared stale")
+	}
+
+	if _, err := store.WriteAt(fb, 2<<4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.mutate(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// preallocStore records the ranges passed to Preallocate.
+type preallocStore struct {
+	storage.Accessor
+	calls [][2]int64
+}
+
+func (s *preallocStore) Preallocate(off, size int64) error {
+	s.calls = append(s.calls, [2]int64{off, size})
+	return nil
+}
+
+func TestPreallocate(t *testing.T) {
+	dir, name := temp()
+	defer os.RemoveAll(dir)
+
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem, err := storage.NewMem(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &preallocStore{Accessor: mem}
+	f, err := NewWithOptions(store, &Options{Preallocate: 1 << 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	h := alloc(f, make([]byte, 100))
+	n := len(store.calls)
+	if n == 0 {
+		t.Fatal("no preallocation")
+	}
+
+	// Growing within the reserved space reserves nothing.
+	h2 := alloc(f, make([]byte, 100))
+	if g := len(store.calls); g != n {
+		t.Fatal(g, n)
+	}
+
+	// Shrinking the file releases the reserved space, growing it again
+	// must reserve it again.
+	free(f, h2)
+	free(f, h)
+	end := f.atoms << 4
+	alloc(f, make([]byte, 100))
+	if g := len(store.calls); g != n+1 || store.calls[n][0] <= end {
+		t.Fatal(store.calls, n, end)
+	}
+}
+
+// crashOps performs some updates of f, returning the handles involved.
+func crashOps(f *File) (ha []int64) {
+	for i := 0; i < 6; i++ {
+		ha = append(ha, alloc(f, bytes.Repeat([]byte{byte(i)}, 100*i)))
+	}
+	free(f, ha[2])
+	ha[3] = realloc(f, ha[3], bytes.Repeat([]byte{30}, 2000), true)
+	ha[4] = realloc(f, ha[4], nil, false)
+	free(f, ha[1])
+	return
+}
+
+// Check that a File kept in a WAL survives a crash at any write, including
+// torn ones, and that Open of a crashed File not using a WAL fails cleanly,
+// if at all.
+func TestCrash(t *testing.T) {
+	sim := storage.NewCrashSim("test.db", nil, nil)
+	f, err := New(sim)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	img := sim.Image(sim.Ops(), 0)
+
+	// Using a WAL.
+	store := storage.NewCrashSim("test.db", img, nil)
+	log := storage.NewCrashSim("test.log", nil, store)
+	w, err := storage.NewWAL(store, log)
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	if f, err = Open(w); err != nil {
+		t.Fatal(30, err)
+	}
+
+	crashOps(f)
+	for i := 0; i <= store.Ops(); i++ {
+		n := store.Sectors(i) + log.Sectors(i)
+		for sectors := 0; sectors <= n; sectors++ {
+			w, err := storage.NewWAL(store.Crash(i, sectors), log.Crash(i, sectors))
+			if err != nil {
+				t.Fatal(40, i, sectors, err)
+			}
+
+			f, err := Open(w)
+			if err != nil {
+				t.Fatal(50, i, sectors, err)
+			}
+
+			if _, _, err := f.audit(); err != nil {
+				t.Fatal(60, i, sectors, err)
+			}
+		}
+	}
+
+	// Not using a WAL.
+	store = storage.NewCrashSim("test.db", img, nil)
+	if f, err = Open(store); err != nil {
+		t.Fatal(70, err)
+	}
+
+	crashOps(f)
+	for i := 0; i <= store.Ops(); i++ {
+		for sectors := 0; sectors <= store.Sectors(i); sectors++ {
+			switch f, err := OpenWithOptions(store.Crash(i, sectors), &Options{Verify: true}); err.(type) {
+			case nil:
+				if _, _, err := f.audit(); err != nil {
+					t.Fatal(90, i, sectors, err)
+				}
+			case *ECorrupted, *EFreeList, *EHeader, *ESize:
+				// ok
+			default:
+				t.Fatalf("%d %d %d %T %v", 80, i, sectors, err, err)
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	f, err := New(storage.NewCrashSim("test.db", nil, nil))
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	a := alloc(f, make([]byte, 100))
+	b := alloc(f, make([]byte, 300))
+	alloc(f, nil)
+	e := alloc(f, nil)
+	alloc(f, nil)
+	free(f, b)
+	r, err := f.Verify()
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	if !r.OK() {
+		t.Fatal(30, r.Violations)
+	}
+
+	if g, e := r.FreeBlocks, int64(1); g != e {
+		t.Fatal(40, g, e)
+	}
+
+	if g, e := r.FreeAtoms, rq2Atoms(300); g != e {
+		t.Fatal(50, g, e)
+	}
+
+	// Used block Z field not zero.
+	f.write([]byte{5}, (a+rq2Atoms(100))<<4-1)
+	// Free block tail size disagreeing with the head size.
+	f.write([]byte{1}, (b+rq2Atoms(300))<<4-2)
+	// Relocation to a free block.
+	buf := make([]byte, 16)
+	buf[0] = 0xfd
+	Handle(b).Put(buf[1:])
+	f.write(buf, e<<4)
+	if r, err = f.Verify(); err != nil {
+		t.Fatal(60, err)
+	}
+
+	if g, e := len(r.Violations), 3; g != e {
+		t.Fatal(70, g, e, r.Violations)
+	}
+
+	for i, atom := range []int64{a, b, e} {
+		if g, e := r.Violations[i].Atom, atom; g != e {
+			t.Fatal(80, i, g, e, r.Violations)
+		}
+	}
+}
+
+// checkVerify checks Verify against the independent audit. Verify checks more
+// rules than audit does, eg. the padding of used blocks, so it may find
+// violations in a damaged File which audit doesn't, but not vice versa. If
+// consistent is true, both must find no violations.
+func checkVerify(t *testing.T, f *File, consistent bool, n ...interface{}) {
+	r, err := f.Verify()
+	if err != nil {
+		t.Fatal(append([]interface{}{"Verify"}, append(n, err)...)...)
+	}
+
+	used, total, err := f.audit()
+	switch {
+	case err != nil && r.OK():
+		t.Fatal(append([]interface{}{"Verify missed"}, append(n, err)...)...)
+	case consistent && !r.OK():
+		t.Fatal(append([]interface{}{"Verify violations"}, append(n, err, r.Violations)...)...)
+	case !r.OK():
+		return
+	}
+
+	if g, e := r.UsedBlocks, used; g != e {
+		t.Fatal(append([]interface{}{"Verify used blocks"}, append(n, g, e)...)...)
+	}
+
+	if g, e := r.UsedBlocks+r.FreeBlocks, total; g != e {
+		t.Fatal(append([]interface{}{"Verify total blocks"}, append(n, g, e)...)...)
+	}
+}
+
+func TestVerifyAudit(t *testing.T) {
+	store := storage.NewCrashSim("test.db", nil, nil)
+	f, err := New(store)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	rng, err := mathutil.NewFC32(0, math.MaxInt32, true)
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	rng.Seed(42)
+	var ha []int64
+	for i := 0; i < 1000; i++ {
+		switch x := rng.Next(); {
+		case len(ha) != 0 && x%3 == 0:
+			j := x % len(ha)
+			free(f, ha[j])
+			ha = append(ha[:j], ha[j+1:]...)
+		case len(ha) != 0 && x%5 == 0:
+			j := x % len(ha)
+			ha[j] = realloc(f, ha[j], make([]byte, x%3000), x%2 == 0)
+		case x%97 == 0:
+			ha = append(ha, alloc(f, make([]byte, maxBlock+x%1000)))
+		default:
+			ha = append(ha, alloc(f, bytes.Repeat([]byte{byte(x)}, x%1000)))
+		}
+		checkVerify(t, f, true, 30, i)
+	}
+
+	// Crashed images not using a WAL are often inconsistent.
+	img := store.Image(store.Ops(), 0)
+	store = storage.NewCrashSim("test.db", img, nil)
+	if f, err = Open(store); err != nil {
+		t.Fatal(40, err)
+	}
+
+	crashOps(f)
+	for i := 0; i <= store.Ops(); i++ {
+		for sectors := 0; sectors <= store.Sectors(i); sectors++ {
+			if f, err := Open(store.Crash(i, sectors)); err == nil {
+				checkVerify(t, f, false, 50, i, sectors)
+			}
+		}
+	}
+
+	// A damaged free lists table is a violation, not an error.
+	b := make([]byte, 17)
+	b[0] = 0xfc
+	Handle(maxBlock + 1).Put(b[3:])
+	f.write(b, 2<<4)
+	r, err := f.Verify()
+	if err != nil {
+		t.Fatal(60, err)
+	}
+
+	if r.OK() || r.Violations[0].Atom != 2 {
+		t.Fatal(70, r.Violations)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	store := storage.NewCrashSim("test.db", nil, nil)
+	f, err := New(store)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	var ha []int64
+	for i := 0; i < 20; i++ {
+		ha = append(ha, alloc(f, bytes.Repeat([]byte{byte(i)}, 50*i)))
+	}
+	for i := 1; i < len(ha)-1; i += 3 {
+		free(f, ha[i])
+	}
+	r, err := f.Verify()
+	if err != nil || !r.OK() {
+		t.Fatal(20, r, err)
+	}
+
+	img := store.Image(store.Ops(), 0)
+
+	// Damaged free lists table.
+	f.write(make([]byte, 14), 32+3+7)
+	// Damaged prev link and head size of a free block.
+	f.write([]byte{0xff, 0xff, 0xff, 0xff}, ha[7]<<4+4)
+	f.write([]byte{0xff, 0xff}, ha[7]<<4+20)
+	if _, err := Open(store); err == nil {
+		t.Fatal(30)
+	}
+
+	rr, err := Repair(store)
+	if err != nil {
+		t.Fatal(40, err)
+	}
+
+	if len(rr.Fixes) != 3 || rr.Fixes[0].Atom != 2 || rr.Fixes[1].Atom != ha[7] || rr.Fixes[2].Atom != ha[7] {
+		t.Fatal(50, rr.Fixes)
+	}
+
+	if g, e := rr.FreeBlocks, r.FreeBlocks; g != e {
+		t.Fatal(60, g, e)
+	}
+
+	if f, err = Open(store); err != nil {
+		t.Fatal(70, err)
+	}
+
+	if r, err = f.Verify(); err != nil || !r.OK() {
+		t.Fatal(80, r, err)
+	}
+
+	for i, h := range ha {
+		if (i-1)%3 == 0 && i < len(ha)-1 {
+			continue
+		}
+
+		b, err := f.Read(Handle(h))
+		if err != nil {
+			t.Fatal(90, err)
+		}
+
+		if g, e := b, bytes.Repeat([]byte{byte(i)}, 50*i); !bytes.Equal(g, e) {
+			t.Fatal(100, i, len(g), len(e))
+		}
+	}
+
+	if g, e := store.Image(store.Ops(), 0), img; !bytes.Equal(g, e) {
+		t.Fatal(110, len(g), len(e))
+	}
+}
+
+func testCompact(t *testing.T, keepHandles bool) {
+	store := storage.NewCrashSim("test.db", nil, nil)
+	f, err := New(store)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	data := map[int64][]byte{}
+	var ha []int64
+	for i := 0; i < 40; i++ {
+		b := bytes.Repeat([]byte{byte(i)}, 37*i)
+		switch i {
+		case 0:
+			b = make([]byte, 20000)
+		case 20, 23:
+			b = bytes.Repeat([]byte{byte(i)}, 150000)
+		}
+		h := alloc(f, b)
+		ha = append(ha, h)
+		data[h] = b
+	}
+	for i := 3; i < len(ha); i += 3 {
+		free(f, ha[i])
+		delete(data, ha[i])
+	}
+	// Relocated blocks at the end of the file.
+	for i := 2; i < len(ha); i += 3 {
+		b := bytes.Repeat([]byte{byte(i)}, 37*i+300)
+		realloc(f, ha[i], b, true)
+		data[ha[i]] = b
+	}
+	free(f, ha[0])
+	delete(data, ha[0])
+	root := []byte("root")
+	realloc(f, 1, bytes.Repeat(root, 20), true)
+	data[1] = bytes.Repeat(root, 20)
+	before, err := f.Verify()
+	if err != nil || !before.OK() {
+		t.Fatal(20, before, err)
+	}
+
+	m, err := f.Compact(keepHandles)
+	if err != nil {
+		t.Fatal(30, err)
+	}
+
+	if keepHandles != (m == nil) {
+		t.Fatal(40, keepHandles, m)
+	}
+
+	after, err := f.Verify()
+	if err != nil || !after.OK() {
+		t.Fatal(50, after, err)
+	}
+
+	if g, e := after.Atoms, before.Atoms; g >= e {
+		t.Fatal(60, g, e)
+	}
+
+	for h, e := range data {
+		if nh, ok := m[Handle(h)]; ok {
+			h = int64(nh)
+		}
+		g, err := f.Read(Handle(h))
+		if err != nil {
+			t.Fatal(70, err)
+		}
+
+		if !bytes.Equal(g, e) {
+			t.Fatal(80, h, len(g), len(e))
+		}
+	}
+
+	if f, err = Open(store); err != nil {
+		t.Fatal(90, err)
+	}
+
+	if r, err := f.Verify(); err != nil || !r.OK() {
+		t.Fatal(100, r, err)
+	}
+
+	t.Logf("keepHandles %t: %d -> %d atoms, free atoms %d -> %d", keepHandles, before.Atoms, after.Atoms, before.FreeAtoms, after.FreeAtoms)
+}
+
+func TestCompact(t *testing.T) {
+	testCompact(t, true)
+	testCompact(t, false)
+}
+
+func TestExtent(t *testing.T) {
+	f, err := New(storage.NewCrashSim("test.db", nil, nil))
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	h0 := alloc(f, []byte("foo"))
+	for i, n := range []int{maxBlock + 1, 2 * maxBlock, 3*maxBlock - 1, 200001} {
+		b := make([]byte, n)
+		for j := range b {
+			b[j] = byte(j*i) | 0xfe
+		}
+
+		h := alloc(f, b)
+		if g, _ := f.readUsed(h); !bytes.Equal(g, b) {
+			t.Fatal(20, i, len(g), len(b))
+		}
+
+		if r, err := f.Verify(); err != nil || !r.OK() {
+			t.Fatal(30, i, r, err)
+		}
+
+		for j, m := range []int{n + 100000, n - 1000, 1000, n} {
+			if h2 := realloc(f, h, b[:1], j&1 == 0); j&1 == 0 && h2 != h {
+				t.Fatal(40, i, j, h, h2)
+			} else {
+				h = h2
+			}
+
+			c := bytes.Repeat([]byte{byte(j)}, m)
+			if h2 := realloc(f, h, c, j&1 == 0); j&1 == 0 && h2 != h {
+				t.Fatal(50, i, j, h, h2)
+			} else {
+				h = h2
+			}
+
+			if g, err := f.Read(Handle(h)); err != nil || !bytes.Equal(g, c) {
+				t.Fatal(60, i, j, len(g), len(c), err)
+			}
+
+			if r, err := f.Verify(); err != nil || !r.OK() {
+				t.Fatal(70, i, j, r, err)
+			}
+		}
+		free(f, h)
+		r, err := f.Verify()
+		if err != nil || !r.OK() {
+			t.Fatal(80, i, r, err)
+		}
+
+		if g, e := r.UsedBlocks, int64(4); g != e {
+			t.Fatal(90, i, g, e)
+		}
+
+		if g, e := r.Atoms, h0+1; g != e {
+			t.Fatal(100, i, g, e)
+		}
+	}
+
+	if _, err := f.Alloc(make([]byte, 10000*maxBlock)); err == nil {
+		t.Fatal(110)
+	}
+}
+
+func TestStream(t *testing.T) {
+	f, err := New(storage.NewCrashSim("test.db", nil, nil))
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	for i, n := range []int{0, 1, 15, 237, 238, 253, maxBlock - 1, maxBlock, maxBlock + 1, 3*maxBlock + 13, 200000} {
+		b := make([]byte, n)
+		for j := range b {
+			b[j] = byte(j*i) | 0xfe
+		}
+
+		w := f.NewWriter()
+		for c := b; len(c) != 0; {
+			m := 1 + 7919*i%10000
+			if m > len(c) {
+				m = len(c)
+			}
+			if k, err := w.Write(c[:m]); k != m || err != nil {
+				t.Fatal(20, i, k, m, err)
+			}
+
+			c = c[m:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(30, i, err)
+		}
+
+		if _, err := w.Write(nil); err == nil {
+			t.Fatal(40, i)
+		}
+
+		h := int64(w.Handle())
+		if g, err := f.Read(Handle(h)); err != nil || !bytes.Equal(g, b) {
+			t.Fatal(50, i, len(g), len(b), err)
+		}
+
+		if n != 0 {
+			h = realloc(f, h, b[:1], true)
+			h = realloc(f, h, b, true)
+		}
+		r, err := f.OpenReader(Handle(h))
+		if err != nil {
+			t.Fatal(60, i, err)
+		}
+
+		g, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(g, b) {
+			t.Fatal(70, i, len(g), len(b), err)
+		}
+
+		for _, off := range []int{0, n / 3, n - 1, n} {
+			if off < 0 {
+				continue
+			}
+
+			if pos, err := r.Seek(int64(off-n), 2); err != nil || pos != int64(off) {
+				t.Fatal(80, i, off, pos, err)
+			}
+
+			g := make([]byte, 3*maxBlock/2)
+			k, err := r.Read(g)
+			if off == n {
+				if k != 0 || err != io.EOF {
+					t.Fatal(90, i, k, err)
+				}
+				continue
+			}
+
+			if err != nil || !bytes.Equal(g[:k], b[off:off+k]) {
+				t.Fatal(100, i, off, k, err)
+			}
+		}
+
+		if r, err := f.Verify(); err != nil || !r.OK() {
+			t.Fatal(110, i, r, err)
+		}
+	}
+
+	if _, err := f.OpenReader(0); err == nil {
+		t.Fatal(120)
+	}
+}
+
+func TestFLTT(t *testing.T) {
+	if _, err := NewWithOptions(storage.NewCrashSim("test.db", nil, nil), &Options{FLTT: 3}); err == nil {
+		t.Fatal(10)
+	}
+
+	for fltt := byte(FLTTExact); fltt <= FLTTFib; fltt++ {
+		store := storage.NewCrashSim("test.db", nil, nil)
+		f, err := NewWithOptions(store, &Options{FLTT: fltt})
+		if err != nil {
+			t.Fatal(20, fltt, err)
+		}
+
+		if g, e := f.canfree, 2+rq2Atoms(14*len(flttClasses[fltt])); g != e {
+			t.Fatal(30, fltt, g, e)
+		}
+
+		rng, err := mathutil.NewFC32(0, math.MaxInt32, true)
+		if err != nil {
+			t.Fatal(40, err)
+		}
+
+		rng.Seed(int64(fltt))
+		var hs []int64
+		m := map[int64][]byte{}
+		for i := 0; i < 2000; i++ {
+			b := make([]byte, rng.Next()%2000)
+			for j := range b {
+				b[j] = byte(rng.Next())
+			}
+			j := 0
+			if len(hs) != 0 {
+				j = rng.Next() % len(hs)
+			}
+			switch op := rng.Next() % 3; {
+			case len(hs) == 0 || op == 0:
+				h := alloc(f, b)
+				hs = append(hs, h)
+				m[h] = b
+			case op == 1:
+				free(f, hs[j])
+				delete(m, hs[j])
+				hs = append(hs[:j], hs[j+1:]...)
+			default:
+				delete(m, hs[j])
+				hs[j] = realloc(f, hs[j], b, rng.Next()%2 == 0)
+				m[hs[j]] = b
+			}
+		}
+		r, err := f.Verify()
+		if err != nil || !r.OK() {
+			t.Fatal(50, fltt, r, err)
+		}
+
+		if f, err = Open(store); err != nil {
+			t.Fatal(55, fltt, err)
+		}
+
+		if f.fltt != fltt {
+			t.Fatal(60, fltt, f.fltt)
+		}
+
+		for h, b := range m {
+			if g, err := f.Read(Handle(h)); err != nil || !bytes.Equal(g, b) {
+				t.Fatal(70, fltt, h, err)
+			}
+		}
+
+		if _, err := store.WriteAt([]byte{0xff}, 15); err != nil {
+			t.Fatal(80, err)
+		}
+
+		if _, err := Open(store); err == nil {
+			t.Fatal(90, fltt)
+		}
+
+		rr, err := Repair(store)
+		if err != nil {
+			t.Fatal(100, fltt, err)
+		}
+
+		if len(rr.Fixes) == 0 || rr.Fixes[0].Atom != 0 {
+			t.Fatal(110, fltt, rr.Fixes)
+		}
+
+		if f, err = Open(store); err != nil || f.fltt != fltt {
+			t.Fatal(120, fltt, err)
+		}
+
+		for h, b := range m {
+			if g, err := f.Read(Handle(h)); err != nil || !bytes.Equal(g, b) {
+				t.Fatal(125, fltt, h, err)
+			}
+		}
+
+		if r, err := f.Verify(); err != nil || !r.OK() {
+			t.Fatal(130, fltt, r, err)
+		}
+	}
+}
+
+type punchStore struct {
+	storage.Accessor
+	holes [][2]int64
+}
+
+func (p *punchStore) PunchHole(off, size int64) error {
+	p.holes = append(p.holes, [2]int64{off, size})
+	_, err := p.WriteAt(make([]byte, size), off)
+	return err
+}
+
+func TestPunchHoles(t *testing.T) {
+	store := &punchStore{Accessor: storage.NewCrashSim("test.db", nil, nil)}
+	f, err := NewWithOptions(store, &Options{PunchHoles: 1 << 12})
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	big := bytes.Repeat([]byte{0xfd}, 20000)
+	a, b, c, d := alloc(f, big), alloc(f, []byte("b")), alloc(f, big), alloc(f, []byte("d"))
+	_, size := f.getInfo(a)
+	free(f, b)
+	if len(store.holes) != 0 {
+		t.Fatal(20, store.holes)
+	}
+
+	free(f, a)
+	if g, e := store.holes, [][2]int64{{(a + 2) << 4, (size + 1 - 3) << 4}}; !reflect.DeepEqual(g, e) {
+		t.Fatal(30, g, e)
+	}
+
+	store.holes = nil
+	e := alloc(f, []byte("e"))
+	if e != a {
+		t.Fatal(40, e, a)
+	}
+
+	if g, e := store.holes, [][2]int64{{(a + 3) << 4, (size - 3) << 4}}; !reflect.DeepEqual(g, e) {
+		t.Fatal(50, g, e)
+	}
+
+	for _, v := range []struct {
+		h int64
+		b []byte
+	}{{c, big}, {d, []byte("d")}, {e, []byte("e")}} {
+		if g, err := f.Read(Handle(v.h)); err != nil || !bytes.Equal(g, v.b) {
+			t.Fatal(60, v.h, err)
+		}
+	}
+
+	if r, err := f.Verify(); err != nil || !r.OK() {
+		t.Fatal(70, r, err)
+	}
+
+	if f, err = OpenWithOptions(store, &Options{PunchHoles: 1 << 12}); err != nil {
+		t.Fatal(80, err)
+	}
+
+	store.holes = nil
+	free(f, c)
+	if len(store.holes) != 1 {
+		t.Fatal(90, store.holes)
+	}
+
+	if r, err := f.Verify(); err != nil || !r.OK() {
+		t.Fatal(100, r, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH == "arm" {
+		t.Skip("needs open file description locks")
+	}
+
+	dir, err := ioutil.TempDir("", "falloc-lock-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "f")
+	store, err := storage.NewFile(fn, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	f, err := NewWithOptions(store, &Options{Lock: fileutil.LockExclusive})
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	ro, err := storage.OpenFile(fn, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(30, err)
+	}
+
+	defer ro.Close()
+
+	if _, err = OpenWithOptions(ro, &Options{Lock: fileutil.LockShared}); err != fileutil.ErrLocked {
+		t.Fatal(40, err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(50, err)
+	}
+
+	g, err := OpenWithOptions(ro, &Options{Lock: fileutil.LockShared})
+	if err != nil {
+		t.Fatal(60, err)
+	}
+
+	rw, err := storage.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(70, err)
+	}
+
+	defer rw.Close()
+
+	if _, err = OpenWithOptions(rw, &Options{Lock: fileutil.LockExclusive}); err != fileutil.ErrLocked {
+		t.Fatal(80, err)
+	}
+
+	if _, err = OpenWithOptions(rw, &Options{Lock: fileutil.LockShared}); err != nil {
+		t.Fatal(90, err)
+	}
+
+	if err = g.Close(); err != nil {
+		t.Fatal(100, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "falloc-ro-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "f")
+	store, err := storage.NewFile(fn, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	f, err := New(store)
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	data := []byte("read only")
+	h, err := f.Alloc(data)
+	if err != nil {
+		t.Fatal(30, err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(40, err)
+	}
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(50, err)
+	}
+
+	if store, err = storage.OpenFile(fn, os.O_RDONLY, 0); err != nil {
+		t.Fatal(60, err)
+	}
+
+	if f, err = OpenReadOnly(store, &Options{PunchHoles: 1, Preallocate: 1 << 20}); err != nil {
+		t.Fatal(70, err)
+	}
+
+	if b, err := f.Read(h); err != nil || !bytes.Equal(b, data) {
+		t.Fatal(80, b, err)
+	}
+
+	if _, err = f.Verify(); err != nil {
+		t.Fatal(90, err)
+	}
+
+	ro := EReadOnly(fn)
+	if _, err = f.Alloc(data); err != ro {
+		t.Fatal(100, err)
+	}
+
+	if err = f.Free(h); err != ro {
+		t.Fatal(110, err)
+	}
+
+	if _, err = f.Realloc(h, nil, true); err != ro {
+		t.Fatal(120, err)
+	}
+
+	if _, err = f.Compact(true); err != ro {
+		t.Fatal(130, err)
+	}
+
+	w := f.NewWriter()
+	if _, err = w.Write(make([]byte, 1<<17)); err != ro {
+		t.Fatal(140, err)
+	}
+
+	if err = w.Close(); err != ro {
+		t.Fatal(150, err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(160, err)
+	}
+
+	if g, err := os.Stat(fn); err != nil || g.Size() != fi.Size() || !g.ModTime().Equal(fi.ModTime()) {
+		t.Fatal(170, err)
+	}
+}
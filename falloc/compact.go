@@ -0,0 +1,233 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package falloc
+
+import (
+	"sort"
+)
+
+// compactRef is the location of a pointer to a block, ie. off is 1 in a
+// relocated block or the offset of a chunk handle in an extent block.
+type compactRef struct {
+	atom, off int64
+}
+
+// compactItem is a used block subject to compaction. c is the atom address of
+// the block. h is its handle, or 0 for extent chunks. ref is the location of
+// the pointer to the block, if any.
+type compactItem struct {
+	h, c, size int64
+	ref        compactRef
+}
+
+type compactItems []*compactItem
+
+func (x compactItems) Len() int           { return len(x) }
+func (x compactItems) Less(i, j int) bool { return x[i].c < x[j].c }
+func (x compactItems) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+// compactor tracks the free space of a File being compacted.
+type compactor struct {
+	*File
+	gaps  []repairFree             // free space, ordered by address, no adjacent items
+	refby map[int64][]*compactItem // extent block atom -> its chunks
+}
+
+// free adds size atoms @atom to the free space.
+func (c *compactor) free(atom, size int64) {
+	i := sort.Search(len(c.gaps), func(i int) bool { return c.gaps[i].atom > atom })
+	c.gaps = append(c.gaps, repairFree{})
+	copy(c.gaps[i+1:], c.gaps[i:])
+	c.gaps[i] = repairFree{atom, size}
+	if i+1 < len(c.gaps) && atom+size == c.gaps[i+1].atom { // join right
+		c.gaps[i].size += c.gaps[i+1].size
+		c.gaps = append(c.gaps[:i+1], c.gaps[i+2:]...)
+	}
+	if i > 0 && c.gaps[i-1].atom+c.gaps[i-1].size == atom { // join left
+		c.gaps[i-1].size += c.gaps[i].size
+		c.gaps = append(c.gaps[:i], c.gaps[i+1:]...)
+	}
+}
+
+// alloc returns the address of the first free space of size atoms below
+// limit, or 0 if there's none.
+func (c *compactor) alloc(size, limit int64) (atom int64) {
+	for i, g := range c.gaps {
+		if g.atom >= limit {
+			return
+		}
+
+		if g.size >= size {
+			c.gaps[i].atom += size
+			if c.gaps[i].size -= size; c.gaps[i].size == 0 {
+				c.gaps = append(c.gaps[:i], c.gaps[i+1:]...)
+			}
+			return g.atom
+		}
+	}
+	return
+}
+
+// move copies the block of it to @to.
+func (c *compactor) move(it *compactItem, to int64) {
+	b := make([]byte, it.size<<4)
+	c.read(b, it.c<<4)
+	c.write(b, to<<4)
+	if chunks, ok := c.refby[it.c]; ok {
+		for _, chunk := range chunks {
+			chunk.ref.atom = to
+		}
+		delete(c.refby, it.c)
+		c.refby[to] = chunks
+	}
+	it.c = to
+}
+
+// repoint updates the pointer to the block of it.
+func (c *compactor) repoint(it *compactItem) {
+	b := make([]byte, 7)
+	Handle(it.c).Put(b)
+	c.write(b, it.ref.atom<<4+it.ref.off)
+}
+
+// reloc writes a relocated block @atom pointing to target.
+func (c *compactor) reloc(atom, target int64) {
+	b := make([]byte, 16)
+	b[0] = 0xfd
+	Handle(target).Put(b[1:])
+	c.write(b, atom<<4)
+}
+
+// Compact moves used blocks of f, starting from the end of the file, into the
+// first fitting free space toward the start of the file and truncates the
+// free space at the end of the file.
+//
+// If keepHandles is true, all handles stay valid. Blocks may then move only by
+// leaving a relocated block (as Realloc with keepHandle does) in place of the
+// block's first atom, so compaction is limited by the relocated blocks left
+// behind. Compact returns a nil map in this mode.
+//
+// If keepHandles is false, relocated blocks, except the root, are dissolved
+// and any block may move. Compact returns a map of every changed handle to
+// its new value. The old handles are no longer valid and all references to
+// them must be rewritten by the caller.
+func (f *File) Compact(keepHandles bool) (m map[Handle]Handle, err error) {
+	err = f.mutate(func() (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				m = nil
+				err = e.(error)
+			}
+		}()
+
+		m = f.compact(keepHandles)
+		return
+	})
+	return
+}
+
+func (f *File) compact(keepHandles bool) (m map[Handle]Handle) {
+	c := &compactor{File: f, refby: map[int64][]*compactItem{}}
+	refs := map[int64]compactRef{} // target -> pointer
+	var blocks []int64
+	for atom := f.canfree; atom < f.atoms; {
+		tag, size := f.getInfo(atom)
+		switch {
+		case tag >= 0xfe:
+			c.free(atom, size)
+		case tag == 0xfd:
+			refs[f.target(atom)] = compactRef{atom, 1}
+		default:
+			_, chunks := f.extent(atom)
+			for i, chunk := range chunks {
+				refs[chunk] = compactRef{atom, 10 + 7*int64(i)}
+			}
+			blocks = append(blocks, atom)
+		}
+		atom += size
+	}
+	if tag, _ := f.getInfo(1); tag == 0xfd {
+		refs[f.target(1)] = compactRef{1, 1}
+	}
+
+	var items compactItems
+	for _, atom := range blocks {
+		_, size := f.getInfo(atom)
+		it := &compactItem{h: atom, c: atom, size: size}
+		if ref, ok := refs[atom]; ok {
+			it.ref = ref
+			if it.h = 0; ref.off == 1 {
+				it.h = ref.atom
+			}
+			c.refby[ref.atom] = append(c.refby[ref.atom], it)
+		}
+		items = append(items, it)
+	}
+	sort.Sort(items)
+
+	if !keepHandles {
+		m = map[Handle]Handle{}
+		for _, it := range items {
+			if it.h != it.c && it.h > 1 {
+				c.free(it.h, 1)
+			}
+		}
+	}
+
+	// Blocks are moved starting from the end of the file, the first fit free
+	// space below a block is used.
+	for i := len(items) - 1; i >= 0; i-- {
+		it := items[i]
+		from := it.c
+		switch {
+		case it.h == it.c: // direct block
+			if keepHandles && it.size == 1 {
+				break
+			}
+
+			to := c.alloc(it.size, from)
+			if to == 0 {
+				break
+			}
+
+			c.move(it, to)
+			if keepHandles {
+				c.reloc(from, to)
+				if it.size > 1 {
+					c.free(from+1, it.size-1)
+				}
+				break
+			}
+
+			m[Handle(it.h)] = Handle(to)
+			c.free(from, it.size)
+		case it.h == 0 || keepHandles || it.h == 1: // chunk or relocation target
+			to := c.alloc(it.size, from)
+			if to == 0 {
+				break
+			}
+
+			c.move(it, to)
+			c.repoint(it)
+			c.free(from, it.size)
+		default: // dissolved relocation
+			to := c.alloc(it.size, from)
+			if to == 0 {
+				m[Handle(it.h)] = Handle(from)
+				break
+			}
+
+			c.move(it, to)
+			m[Handle(it.h)] = Handle(to)
+			c.free(from, it.size)
+		}
+	}
+
+	for _, g := range c.gaps {
+		f.makeFree(0, g.atom, g.size, 0)
+	}
+	f.repair(&RepairReport{})
+	return
+}
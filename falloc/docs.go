@@ -96,6 +96,31 @@ bellow 238 are reserved, those content lengths are to be carried by the
 
 Discussion of the padding and Z fields - see the 0x01..0xED block type.
 
+ 5. n == 0x0000 is an extent block, see below. Other n values bellow 0x00EE
+    are reserved.
+
+------------------------------------------------------------------------------
+
+0xFC, n == 0x0000: Used extent block.
+ +------++--------++---------++---------------------++---------+------+
+ |  0   || 1...2  ||  3...9  ||     10...10+7k-1    ||         |      |
+ +------++--------++---------++---------------------++---------+------+
+ | 0xFC || 0x0000 || L6...L0 || k chunk atom ptrs   || padding | 0x00 |
+ +------++--------++---------++---------------------++---------+------+
+
+This block type is used for content of length L > 61680 bytes. L is encoded as
+a 7 byte unsigned integer in network byte order. The content is split into k ==
+ceil(L/61680) chunks, every chunk is stored in a separate used block of the
+0x01..0xFC types. All chunks, except the last one, carry exactly 61680 bytes.
+The atom addresses of the chunks, in content order, are encoded as 7 byte
+unsigned integers in network byte order. Every chunk is referenced by exactly
+one extent block, a chunk is not a valid handle on its own.
+
+The extent block itself is limited by the largest block size of 3856 atoms,
+thus L is at most 61680 * 8812 bytes (about 543 MB).
+
+An extent block can be the target of a relocation.
+
 ------------------------------------------------------------------------------
 
 0xEE...0xFB: Used escaped short block.
@@ -210,7 +235,8 @@ The largest possible allocation request (for content length 61680 bytes) is
 into a single table item with the size 3856. It may be useful to additionally
 have a free lists table item which links free blocks of some bigger size (say
 1M+) and then use the OS sparse file support (if present) to save the physical
-space used by such free blocks.
+space used by such free blocks. This package punches holes in the interior of
+large free blocks if asked to, see Options.PunchHoles.
 
 Smaller (<3856 atoms) free blocks can be organized exactly (every distinct size
 has its table item) or the sizes can run using other schema like e.g. "1, 2,
@@ -243,6 +269,22 @@ FLTT describes the type of the Free List Table. Currently defined values:
 
 FLTT == 0: Free List Table is fixed at atom address 2. It has a fixed size for 3856 entries
 for free list of size 1..3855 atoms and the last is for the list of free block >= 3856 atoms.
+
+------------------------------------------------------------------------------
+
+FLTT == 1: Free List Table is fixed at atom address 2. It has a fixed size for 13 entries
+for free lists of size 1, 2, 4, ..., 2048 atoms (powers of 2) and the last is for the list
+of free blocks >= 3856 atoms. The table occupies 12 atoms.
+
+------------------------------------------------------------------------------
+
+FLTT == 2: Free List Table is fixed at atom address 2. It has a fixed size for 18 entries
+for free lists of size 1, 2, 3, 5, ..., 2584 atoms (the Fibonacci sequence) and the last is
+for the list of free blocks >= 3856 atoms. The table occupies 16 atoms.
+
+For FLTT 1 and 2 a free list holds blocks of different sizes, an allocation
+request of n atoms is satisfied by the first block of size >= n found on the list
+of the highest size <= n or by the head of any list of a higher size.
 */
 package falloc
 
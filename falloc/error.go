@@ -28,6 +28,13 @@ func (e *EClose) Error() string {
 	return fmt.Sprintf("%sx: %s", e.Name, e.Err)
 }
 
+// EClosed is an error produced by using a closed Writer.
+type EClosed string
+
+func (e EClosed) Error() string {
+	return fmt.Sprintf("%s: use of a closed writer", string(e))
+}
+
 // ECorrupted is a file/store format error.
 type ECorrupted struct {
 	Name string
@@ -108,6 +115,13 @@ func (e *ERead) Error() string {
 	return fmt.Sprintf("%s, %#x: %s", e.Name, e.Ofs, e.Err)
 }
 
+// EReadOnly is an error produced by modifying a File opened by OpenReadOnly.
+type EReadOnly string
+
+func (e EReadOnly) Error() string {
+	return fmt.Sprintf("%s: read only", string(e))
+}
+
 // ESize is a file/store size error.
 type ESize struct {
 	Name string
@@ -16,6 +16,7 @@ package falloc
 
 import (
 	"bytes"
+	"github.com/cznic/fileutil"
 	"github.com/cznic/fileutil/storage"
 	"sync"
 )
@@ -43,11 +44,20 @@ func (h *Handle) Get(b []byte) {
 
 // File is a file/store with space allocation/deallocation support.
 type File struct {
-	f       storage.Accessor
-	atoms   int64       // current file size in atom units
-	canfree int64       // only blocks >= canfree can be subject to Free()
-	freetab [3857]int64 // freetab[0] is unused, freetab[1] is size 1 ptr, freetab[2] is size 2 ptr, ...
-	rwm     sync.RWMutex
+	f        storage.Accessor
+	atoms    int64           // current file size in atom units
+	canfree  int64           // only blocks >= canfree can be subject to Free()
+	classes  []int64         // sizes of the free lists
+	fltt     byte            // free lists table type
+	freetab  [3857]int64     // freetab[0] is unused, freetab[1] is size 1 ptr, freetab[2] is size 2 ptr, ...
+	nest     int             // mutate nesting level
+	prealloc int64           // size of the chunks of space reserved beyond the end of file, 0 == none
+	punch    int64           // minimum size in atoms of free blocks to punch holes in, 0 == never
+	punches  map[int64]int64 // free block atom -> size, holes to punch after the current update
+	reserved int64           // file offset up to which space was reserved
+	ro       bool            // opened by OpenReadOnly, the store is never written
+	stale    bool            // atoms, canfree and freetab must be reloaded
+	rwm      sync.RWMutex
 }
 
 func (f *File) read(b []byte, off int64) {
@@ -62,6 +72,9 @@ func (f *File) write(b []byte, off int64) {
 	}
 }
 
+// maxBlock is the maximum content length of a single used block.
+const maxBlock = 61680
+
 var ( // R/O
 	hdr   = []byte{0x0f, 0xf1, 0xc1, 0xa1, 0xfe, 0xa5, 0x1b, 0x1e, 0, 0, 0, 0, 0, 0, 2, 0} // free lists table @2
 	empty = make([]byte, 16)
@@ -69,16 +82,74 @@ var ( // R/O
 	zero7 = make([]byte, 7)
 )
 
+// Options amend the behavior of NewWithOptions and OpenWithOptions. The zero
+// value is the default.
+type Options struct {
+	// Type of the free lists table. Used only by NewWithOptions.
+	FLTT byte
+
+	// If non zero, the physical space of the interior of free blocks of at
+	// least PunchHoles bytes is deallocated when the update creating such
+	// free block ends, provided the store is a storage.PunchHoler. The
+	// first two and the last atom of the free block are kept intact.
+	PunchHoles int64
+
+	// If non zero, space beyond the end of the file is reserved in chunks
+	// of Preallocate bytes when the file grows, provided the store is a
+	// storage.Preallocator. The file size is not affected.
+	Preallocate int64
+
+	// If non zero, the store is locked in the Lock mode by
+	// NewWithOptions or OpenWithOptions, provided the store is a
+	// storage.FileLocker, eg. to protect it against other processes. If
+	// the store is already locked, fileutil.ErrLocked is returned. The
+	// lock is released when the store is closed.
+	Lock fileutil.LockMode
+
+	// If true, OpenWithOptions checks the whole store using Verify and
+	// fails with ECorrupted if any violation is found. Without a WAL an
+	// update interrupted by a crash can leave the store inconsistent.
+	// Used only by OpenWithOptions.
+	Verify bool
+}
+
 // New returns a new File backed by store or an error if any.
 // Any existing data in store are discarded.
 func New(store storage.Accessor) (f *File, err error) {
-	f = &File{f: store}
-	return f, storage.Mutate(store, func() (err error) {
+	return NewWithOptions(store, nil)
+}
+
+// NewWithOptions is like New, but the File is created according to opts. If
+// opts is nil, the default options are used.
+func NewWithOptions(store storage.Accessor, opts *Options) (f *File, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	f = &File{f: store, prealloc: opts.Preallocate}
+	f.setPunch(opts.PunchHoles)
+	if !f.setFLTT(opts.FLTT) {
+		return nil, &EBadRequest{store.Name(), int(opts.FLTT)}
+	}
+
+	if opts.Lock != 0 {
+		if err = storage.TryLock(store, opts.Lock); err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if err != nil {
+				storage.Unlock(store)
+			}
+		}()
+	}
+
+	return f, f.mutate(func() (err error) {
 		if err = f.f.Truncate(0); err != nil {
 			return &ECreate{f.f.Name(), err}
 		}
 
-		if _, err = f.Alloc(hdr[1:]); err != nil { //TODO internal panicking versions of the exported fns.
+		if _, err = f.Alloc(header(f.fltt)[1:]); err != nil { //TODO internal panicking versions of the exported fns.
 			return
 		}
 
@@ -86,11 +157,7 @@ func New(store storage.Accessor) (f *File, err error) {
 			return
 		}
 
-		b := make([]byte, 3856*14)
-		for i := 1; i <= 3856; i++ {
-			Handle(i).Put(b[(i-1)*14:])
-		}
-		if _, err = f.Alloc(b); err != nil {
+		if _, err = f.Alloc(f.table()); err != nil {
 			return
 		}
 
@@ -102,13 +169,32 @@ func New(store storage.Accessor) (f *File, err error) {
 // Open returns a new File backed by store or an error if any.
 // Store already has to be in a valid format.
 func Open(store storage.Accessor) (f *File, err error) {
+	return OpenWithOptions(store, nil)
+}
+
+// OpenWithOptions is like Open, but the File is opened according to opts. If
+// opts is nil, the default options are used. The FLTT option is ignored, the
+// free lists table type is taken from the header.
+func OpenWithOptions(store storage.Accessor, opts *Options) (f *File, err error) {
+	var locked bool
 	defer func() {
 		if e := recover(); e != nil {
 			f = nil
 			err = e.(error)
+			if locked {
+				storage.Unlock(store)
+			}
 		}
 	}()
 
+	if opts != nil && opts.Lock != 0 {
+		if err = storage.TryLock(store, opts.Lock); err != nil {
+			return nil, err
+		}
+
+		locked = true
+	}
+
 	fi, err := store.Stat()
 	if err != nil {
 		panic(&EOpen{store.Name(), err})
@@ -120,14 +206,46 @@ func Open(store storage.Accessor) (f *File, err error) {
 	}
 
 	f = &File{f: store, atoms: fs >> 4}
+	if opts != nil {
+		f.prealloc = opts.Preallocate
+		f.setPunch(opts.PunchHoles)
+	}
 	b := make([]byte, len(hdr))
 	f.read(b, 0)
-	if !bytes.Equal(b, hdr) {
+	if !bytes.Equal(b[:15], hdr[:15]) || !f.setFLTT(b[15]) {
 		panic(&EHeader{store.Name(), b, append([]byte{}, hdr...)})
 	}
 
-	var atoms int64
-	b, atoms = f.readUsed(2)
+	f.loadFreeTab()
+	if opts != nil && opts.Verify {
+		r, err := f.Verify()
+		if err != nil {
+			panic(err)
+		}
+
+		if !r.OK() {
+			panic(&ECorrupted{store.Name(), r.Violations[0].Atom << 4})
+		}
+	}
+	return
+}
+
+// OpenReadOnly is like OpenWithOptions, but the returned File cannot be
+// modified. All of its methods modifying it return EReadOnly and the store is
+// never written to, thus it can be a read-only Accessor. The PunchHoles and
+// Preallocate options are ignored. Use the Lock option with
+// fileutil.LockShared to prevent a writer in another process from modifying
+// the store while it's being read.
+func OpenReadOnly(store storage.Accessor, opts *Options) (f *File, err error) {
+	if f, err = OpenWithOptions(store, opts); f != nil {
+		f.ro, f.prealloc, f.punch = true, 0, 0
+	}
+	return
+}
+
+// loadFreeTab reads the free lists table.
+func (f *File) loadFreeTab() {
+	b, atoms := f.readUsed(2)
 	f.canfree = atoms + 2
 	ofs := 0
 	var size, p Handle
@@ -136,12 +254,73 @@ func Open(store storage.Accessor) (f *File, err error) {
 		ofs += 7
 		p.Get(b[ofs:])
 		ofs += 7
-		if sz, pp := int64(size), int64(p); size == 0 || size > 3856 || (pp != 0 && pp < f.canfree) || pp<<4 > fs-16 {
-			panic(&EFreeList{store.Name(), sz, pp})
+		if sz, pp := int64(size), int64(p); size == 0 || size > 3856 || f.class(sz) != sz || (pp != 0 && pp < f.canfree) || pp >= f.atoms {
+			panic(&EFreeList{f.f.Name(), sz, pp})
 		}
 
 		f.freetab[size] = int64(p)
 	}
+}
+
+// mutate executes fn as an update of the store. If the update fails and the
+// store is a storage.Rollbacker, i.e. the update may have been discarded, the
+// in-memory state of f is reloaded from the store before the next update.
+func (f *File) mutate(fn func() error) (err error) {
+	if f.ro {
+		return EReadOnly(f.f.Name())
+	}
+
+	if f.stale {
+		if err = f.reload(); err != nil {
+			return
+		}
+	}
+
+	ok := false
+	f.nest++
+	defer func() {
+		if !ok {
+			_, f.stale = f.f.(storage.Rollbacker)
+		}
+		if f.nest--; f.nest == 0 {
+			if ok {
+				f.punchHoles()
+			}
+			f.punches = nil
+		}
+	}()
+
+	err = storage.Mutate(f.f, fn)
+	ok = err == nil
+	return
+}
+
+// reload rereads the file size and the free lists table. Errors reading the
+// store and a damaged table are returned, f stays stale then. Any other panic is
+// propagated.
+func (f *File) reload() (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			switch x := e.(type) {
+			case *ECorrupted, *EFreeList, *ERead:
+				err = x.(error)
+			default:
+				panic(e)
+			}
+		}
+	}()
+
+	fi, err := f.f.Stat()
+	if err != nil {
+		return
+	}
+
+	// A rolled back update may have shrunk the file.
+	if f.atoms = fi.Size() >> 4; f.reserved > f.atoms<<4 {
+		f.reserved = f.atoms << 4
+	}
+	f.loadFreeTab()
+	f.stale = false
 	return
 }
 
@@ -152,6 +331,13 @@ func (f *File) Accessor() storage.Accessor {
 
 // Close closes f and returns an error if any.
 func (f *File) Close() (err error) {
+	if f.ro {
+		if err = f.f.Close(); err != nil {
+			err = &EClose{f.f.Name(), err}
+		}
+		return
+	}
+
 	return storage.Mutate(f.Accessor(), func() (err error) {
 		if err = f.f.Close(); err != nil {
 			err = &EClose{f.f.Name(), err}
@@ -187,6 +373,8 @@ redir:
 		switch {
 		default:
 			panic(&ECorrupted{f.f.Name(), ofs + 1})
+		case n == 0: // Extent
+			return f.readExtent(atom)
 		case n >= 238 && n <= 61680: // Long non esc
 			content = make([]byte, n)
 			f.read(content, ofs+3)
@@ -262,44 +450,170 @@ func rq2Atoms(rqbytes int) (rqatoms int64) {
 	return int64(rqbytes>>4 + 1)
 }
 
-func (f *File) extend(b []byte) (handle int64) {
+func (f *File) extend(atoms int64, write func(atom int64)) (handle int64) {
 	handle = f.atoms
-	f.writeUsed(b, handle)
-	f.atoms += rq2Atoms(len(b))
+	f.atoms += atoms
+	if end := f.atoms << 4; f.prealloc > 0 && end > f.reserved {
+		f.reserved = end + f.prealloc
+		storage.Preallocate(f.f, end, f.prealloc) // only an optimization
+	}
+	write(handle)
+	return
+}
+
+// encode returns the size in atoms of a used block holding b and a function
+// writing the block at some atom address. Content longer than maxBlock is
+// stored in chunks allocated by encode and the block is then an extent block.
+func (f *File) encode(b []byte) (atoms int64, write func(atom int64), err error) {
+	if len(b) <= maxBlock {
+		return rq2Atoms(len(b)), func(atom int64) { f.writeUsed(b, atom) }, nil
+	}
+
+	l := int64(len(b))
+	if atoms = extentAtoms(l); atoms > 3856 {
+		return 0, nil, &EBadRequest{f.f.Name(), len(b)}
+	}
+
+	var chunks []int64
+	for len(b) != 0 {
+		chunk := b
+		if len(chunk) > maxBlock {
+			chunk = chunk[:maxBlock]
+		}
+		b = b[len(chunk):]
+		chunks = append(chunks, f.alloc(rq2Atoms(len(chunk)), func(atom int64) { f.writeUsed(chunk, atom) }))
+	}
+	atoms, write = f.encodeExtent(l, chunks)
+	return
+}
+
+// encodeExtent returns the size in atoms of an extent block for content of
+// length l stored in chunks and a function writing the block at some atom
+// address.
+func (f *File) encodeExtent(l int64, chunks []int64) (atoms int64, write func(atom int64)) {
+	x := make([]byte, 10+7*len(chunks))
+	x[0] = 0xfc
+	Handle(l).Put(x[3:])
+	for i, h := range chunks {
+		Handle(h).Put(x[10+7*i:])
+	}
+	atoms = extentAtoms(l)
+	return atoms, func(atom int64) {
+		f.write(x, atom<<4)
+		f.write(zero, (atom+atoms)<<4-1)
+	}
+}
+
+// extentAtoms returns the size in atoms of an extent block for content of
+// length l.
+func extentAtoms(l int64) int64 {
+	return (10 + 7*((l+maxBlock-1)/maxBlock) + 1 + 15) >> 4
+}
+
+// extent returns the content length and the chunks of the extent block
+// @atom. If the block is not an extent block, extent returns -1 and nil.
+func (f *File) extent(atom int64) (l int64, chunks []int64) {
+	b := make([]byte, 10)
+	f.read(b[:3], atom<<4)
+	if b[0] != 0xfc || b[1] != 0 || b[2] != 0 {
+		return -1, nil
+	}
+
+	f.read(b[3:], atom<<4+3)
+	(*Handle)(&l).Get(b[3:])
+	if l <= maxBlock {
+		panic(&ECorrupted{f.f.Name(), atom<<4 + 3})
+	}
+
+	b = make([]byte, 7*((l+maxBlock-1)/maxBlock))
+	f.read(b, atom<<4+10)
+	for ; len(b) != 0; b = b[7:] {
+		var h int64
+		(*Handle)(&h).Get(b)
+		chunks = append(chunks, h)
+	}
 	return
 }
 
+// readExtent returns the content of the extent block @atom and its size in
+// atoms.
+func (f *File) readExtent(atom int64) (content []byte, atoms int64) {
+	l, chunks := f.extent(atom)
+	content = make([]byte, 0, l)
+	for _, h := range chunks {
+		if h < f.canfree || h >= f.atoms {
+			panic(&ECorrupted{f.f.Name(), atom << 4})
+		}
+
+		if pre, _ := f.getInfo(h); pre >= 0xfd || f.isExtent(h) {
+			panic(&ECorrupted{f.f.Name(), h << 4})
+		}
+
+		c, _ := f.readUsed(h)
+		if n := int64(len(c)); n != maxBlock && n != l-int64(len(content)) {
+			panic(&ECorrupted{f.f.Name(), h << 4})
+		}
+
+		content = append(content, c...)
+	}
+	if int64(len(content)) != l {
+		panic(&ECorrupted{f.f.Name(), atom << 4})
+	}
+
+	return content, extentAtoms(l)
+}
+
+// isExtent returns whether the block @atom is an extent block.
+func (f *File) isExtent(atom int64) bool {
+	b := make([]byte, 3)
+	f.read(b, atom<<4)
+	return b[0] == 0xfc && b[1] == 0 && b[2] == 0
+}
+
+// freeChunks frees the chunks of the block @atom, if it's an extent block.
+func (f *File) freeChunks(atom int64) {
+	_, chunks := f.extent(atom)
+	for _, h := range chunks {
+		f.free(h)
+	}
+}
+
 // Alloc stores b in a newly allocated space and returns its handle and an error if any.
+// Content longer than 61680 bytes is stored in an extent block, see docs.go.
 func (f *File) Alloc(b []byte) (handle Handle, err error) {
-	err = storage.Mutate(f.Accessor(), func() (err error) {
-		rqAtoms := rq2Atoms(len(b))
-		if rqAtoms > 3856 {
-			return &EBadRequest{f.f.Name(), len(b)}
-		}
-
-		for foundsize, foundp := range f.freetab[rqAtoms:] {
-			if foundp != 0 {
-				// this works only for the current unique sizes list (except the last item!)
-				size := int64(foundsize) + rqAtoms
-				handle = Handle(foundp)
-				if size == 3856 {
-					buf := make([]byte, 7)
-					f.read(buf, int64(handle)<<4+15)
-					(*Handle)(&size).Get(buf)
-				}
-				f.delFree(int64(handle), size)
+	err = f.mutate(func() (err error) {
+		atoms, write, err := f.encode(b)
+		if err != nil {
+			return
+		}
+
+		handle = Handle(f.alloc(atoms, write))
+		return
+	})
+	return
+}
+
+// alloc allocates a block of rqAtoms, writes it using write and returns its
+// atom address.
+func (f *File) alloc(rqAtoms int64, write func(atom int64)) (handle int64) {
+	b := make([]byte, 7)
+	for _, class := range f.classes[f.index(rqAtoms):] {
+		// Only the lists of sizes <= rqAtoms may hold blocks too small.
+		for handle = f.freetab[class]; handle != 0; (*Handle)(&handle).Get(b) {
+			if size, _ := f.getSize(handle); size >= rqAtoms {
+				f.delFree(handle, size)
 				if rqAtoms < size {
-					f.addFree(int64(handle)+rqAtoms, size-rqAtoms)
+					f.addFree(handle+rqAtoms, size-rqAtoms)
 				}
-				f.writeUsed(b, int64(handle))
+				write(handle)
 				return
 			}
+
+			f.read(b, handle<<4+8)
 		}
+	}
 
-		handle = Handle(f.extend(b))
-		return
-	})
-	return
+	return f.extend(rqAtoms, write)
 }
 
 // checkLeft returns the atom size of a free bleck left adjacent to block @atom.
@@ -342,6 +656,11 @@ func (f *File) getInfo(atom int64) (pref byte, size int64) {
 		switch {
 		default:
 			panic(&ECorrupted{f.f.Name(), fp + 1})
+		case n == 0: // Extent
+			var l int64
+			f.read(b, fp+3)
+			(*Handle)(&l).Get(b)
+			size = extentAtoms(l)
 		case n >= 238 && n <= 61680: // Long non esc
 			size = rq2Atoms(n)
 		case n >= 61681: // Long esc
@@ -382,11 +701,9 @@ func (f *File) checkRight(atom, atoms int64) (size int64) {
 // delFree removes the atoms@atom free block from the free block list
 func (f *File) delFree(atom, atoms int64) {
 	b := make([]byte, 15)
-	size := int(atoms)
-	if n := len(f.freetab); atoms >= int64(n) {
-		size = n - 1
-	}
+	size := f.class(atoms)
 	fp := atom << 4
+	delete(f.punches, atom)
 	f.read(b[1:], fp+1)
 	var prev, next Handle
 	prev.Get(b[1:])
@@ -395,7 +712,7 @@ func (f *File) delFree(atom, atoms int64) {
 	switch {
 	case prev == 0 && next != 0:
 		next.Put(b)
-		f.write(b[:7], int64(32+3+7+(size-1)*14))
+		f.write(b[:7], f.item(size))
 		f.write(zero7, int64(next)<<4+1)
 		f.freetab[size] = int64(next)
 	case prev != 0 && next == 0:
@@ -406,7 +723,7 @@ func (f *File) delFree(atom, atoms int64) {
 		next.Put(b)
 		f.write(b[:7], int64(prev)<<4+8)
 	default: // prev == 0 && next == 0:
-		f.write(zero7, int64(32+3+7+(size-1)*14))
+		f.write(zero7, f.item(size))
 		f.freetab[size] = 0
 	}
 }
@@ -414,15 +731,12 @@ func (f *File) delFree(atom, atoms int64) {
 // addFree adds atoms@atom to the free block lists and marks it free.
 func (f *File) addFree(atom, atoms int64) {
 	b := make([]byte, 7)
-	size := int(atoms)
-	if n := len(f.freetab); atoms >= int64(n) {
-		size = n - 1
-	}
+	size := f.class(atoms)
 	head := f.freetab[size]
 	if head == 0 { // empty list
 		f.makeFree(0, atom, atoms, 0)
 		Handle(atom).Put(b)
-		f.write(b, int64(32+3+7+(size-1)*14))
+		f.write(b, f.item(size))
 		f.freetab[size] = atom
 		return
 	}
@@ -430,7 +744,7 @@ func (f *File) addFree(atom, atoms int64) {
 	Handle(atom).Put(b)
 	f.write(b, head<<4+1)            // head.prev = atom
 	f.makeFree(0, atom, atoms, head) // atom.next = head
-	f.write(b, int64(32+3+7+(size-1)*14))
+	f.write(b, f.item(size))
 	f.freetab[size] = atom
 }
 
@@ -438,6 +752,12 @@ func (f *File) addFree(atom, atoms int64) {
 func (f *File) makeFree(prev, atom, atoms, next int64) {
 	b := make([]byte, 23)
 	fp := atom << 4
+	if f.punch != 0 && atoms >= f.punch {
+		if f.punches == nil {
+			f.punches = map[int64]int64{}
+		}
+		f.punches[atom] = atoms
+	}
 	if atoms == 1 {
 		b[0] = 0xff
 		Handle(prev).Put(b[1:])
@@ -483,44 +803,72 @@ func (f *File) Read(handle Handle) (b []byte, err error) {
 // invalid data on Read. It's like corrupting memory via passing an invalid pointer to C.free()
 // or reusing that pointer.
 func (f *File) Free(handle Handle) (err error) {
-	return storage.Mutate(f.Accessor(), func() (err error) {
+	return f.mutate(func() (err error) {
 		atom := int64(handle)
-		atoms, isFree := f.getSize(atom)
-		if isFree || atom < f.canfree {
+		typ, _ := f.getInfo(atom)
+		if typ >= 0xfe || atom < f.canfree {
 			return &EHandle{f.f.Name(), handle}
 		}
 
-		leftFree, rightFree := f.checkLeft(atom), f.checkRight(atom, atoms)
-		switch {
-		case leftFree != 0 && rightFree != 0:
-			f.delFree(atom-leftFree, leftFree)
-			f.delFree(atom+atoms, rightFree)
-			f.addFree(atom-leftFree, leftFree+atoms+rightFree)
-		case leftFree != 0 && rightFree == 0:
-			f.delFree(atom-leftFree, leftFree)
-			if atom+atoms == f.atoms { // the left free neighbour and this block together are an empy tail
-				f.atoms = atom - leftFree
-				f.f.Truncate(f.atoms << 4)
-				return
-			}
-
-			f.addFree(atom-leftFree, leftFree+atoms)
-		case leftFree == 0 && rightFree != 0:
-			f.delFree(atom+atoms, rightFree)
-			f.addFree(atom, atoms+rightFree)
-		default: // leftFree == 0 && rightFree == 0
-			if atom+atoms < f.atoms { // isolated inner block
-				f.addFree(atom, atoms)
-				return
-			}
-
-			f.f.Truncate(atom << 4) // isolated tail block, shrink file
-			f.atoms = atom
+		if typ == 0xfd {
+			target := f.target(atom)
+			f.freeChunks(target)
+			f.free(target)
 		}
+		f.freeChunks(atom)
+		f.free(atom)
 		return
 	})
 }
 
+// target returns the target of the relocated block @atom.
+func (f *File) target(atom int64) (target int64) {
+	b := make([]byte, 7)
+	f.read(b, atom<<4+1)
+	(*Handle)(&target).Get(b)
+	return
+}
+
+// free frees the block @atom, merging it with its free neighbours.
+func (f *File) free(atom int64) {
+	atoms, _ := f.getSize(atom)
+	leftFree, rightFree := f.checkLeft(atom), f.checkRight(atom, atoms)
+	switch {
+	case leftFree != 0 && rightFree != 0:
+		f.delFree(atom-leftFree, leftFree)
+		f.delFree(atom+atoms, rightFree)
+		f.addFree(atom-leftFree, leftFree+atoms+rightFree)
+	case leftFree != 0 && rightFree == 0:
+		f.delFree(atom-leftFree, leftFree)
+		if atom+atoms == f.atoms { // the left free neighbour and this block together are an empy tail
+			f.truncate(atom - leftFree)
+			return
+		}
+
+		f.addFree(atom-leftFree, leftFree+atoms)
+	case leftFree == 0 && rightFree != 0:
+		f.delFree(atom+atoms, rightFree)
+		f.addFree(atom, atoms+rightFree)
+	default: // leftFree == 0 && rightFree == 0
+		if atom+atoms < f.atoms { // isolated inner block
+			f.addFree(atom, atoms)
+			return
+		}
+
+		f.truncate(atom) // isolated tail block, shrink file
+	}
+}
+
+// truncate shrinks the file to atoms. Space reserved beyond the end of the
+// file is released by truncating it, extend has to reserve it again.
+func (f *File) truncate(atoms int64) {
+	f.atoms = atoms
+	f.f.Truncate(atoms << 4)
+	if end := atoms << 4; f.reserved > end {
+		f.reserved = end
+	}
+}
+
 // Realloc reallocates space associted with handle to acomodate b, returns the newhandle
 // newly associated with b and an error if any. If keepHandle == true then Realloc guarantees
 // newhandle == handle even if the new data are larger then the previous content associated
@@ -528,96 +876,89 @@ func (f *File) Free(handle Handle) (err error) {
 // the database.
 // The above effects are like corrupting memory/data via passing an invalid pointer to C.realloc().
 func (f *File) Realloc(handle Handle, b []byte, keepHandle bool) (newhandle Handle, err error) {
-	err = storage.Mutate(f.Accessor(), func() (err error) {
+	err = f.mutate(func() (err error) {
 		switch handle {
 		case 0, 2:
 			return &EHandle{f.f.Name(), handle}
 		case 1:
 			keepHandle = true
 		}
-		newhandle = handle
-		atom, newatoms := int64(handle), rq2Atoms(len(b))
-		if newatoms > 3856 {
-			return &EBadRequest{f.f.Name(), len(b)}
+		atom := int64(handle)
+		if typ, _ := f.getInfo(atom); typ >= 0xfe {
+			return &ECorrupted{f.f.Name(), atom << 4}
 		}
 
-		typ, oldatoms := f.getInfo(atom)
-		switch {
-		default:
-			return &ECorrupted{f.f.Name(), atom << 4}
-		case typ <= 0xfc: // non relocated used block
-			switch {
-			case newatoms == oldatoms: // in place replace
-				f.writeUsed(b, atom)
-			case newatoms < oldatoms: // in place shrink
-				rightFree := f.checkRight(atom, oldatoms)
-				if rightFree > 0 { // right join
-					f.delFree(atom+oldatoms, rightFree)
-				}
-				f.addFree(atom+newatoms, oldatoms+rightFree-newatoms)
-				f.writeUsed(b, atom)
-			case newatoms > oldatoms:
-				if rightFree := f.checkRight(atom, oldatoms); rightFree > 0 && newatoms <= oldatoms+rightFree {
-					f.delFree(atom+oldatoms, rightFree)
-					if newatoms < oldatoms+rightFree {
-						f.addFree(atom+newatoms, oldatoms+rightFree-newatoms)
-					}
-					f.writeUsed(b, atom)
-					return
-				}
+		newatoms, write, err := f.encode(b)
+		if err != nil {
+			return
+		}
 
-				if !keepHandle {
-					f.Free(Handle(atom))
-					newhandle, err = f.Alloc(b)
-					return
-				}
+		newhandle = Handle(f.realloc(atom, newatoms, write, keepHandle))
+		return
+	})
+	return
+}
 
-				// reloc
-				newatom, e := f.Alloc(b)
-				if e != nil {
-					return e
+// realloc reallocates the used block @atom to newatoms, writes it using write
+// and returns its new atom address.
+func (f *File) realloc(atom, newatoms int64, write func(atom int64), keepHandle bool) int64 {
+	typ, oldatoms := f.getInfo(atom)
+	if typ == 0xfd { // reloc
+		target := f.target(atom)
+		if newatoms > 1 {
+			rightFree := f.checkRight(atom, 1)
+			if rightFree == 0 || newatoms > 1+rightFree {
+				if newtarget := f.realloc(target, newatoms, write, false); newtarget != target {
+					buf := make([]byte, 7)
+					Handle(newtarget).Put(buf)
+					f.write(buf, atom<<4+1)
 				}
-
-				buf := make([]byte, 16)
-				buf[0] = 0xfd
-				Handle(newatom).Put(buf[1:])
-				f.Realloc(Handle(atom), buf[1:], true)
-				f.write(buf[:1], atom<<4)
+				return atom
 			}
-		case typ == 0xfd: // reloc
-			var target Handle
-			buf := make([]byte, 7)
-			f.read(buf, atom<<4+1)
-			target.Get(buf)
-			switch {
-			case newatoms == 1:
-				f.writeUsed(b, atom)
-				f.Free(target)
-			default:
-				if rightFree := f.checkRight(atom, 1); rightFree > 0 && newatoms <= 1+rightFree {
-					f.delFree(atom+1, rightFree)
-					if newatoms < 1+rightFree {
-						f.addFree(atom+newatoms, 1+rightFree-newatoms)
-					}
-					f.writeUsed(b, atom)
-					f.Free(target)
-					return
-				}
 
-				newtarget, e := f.Realloc(Handle(target), b, false)
-				if e != nil {
-					return e
-				}
+			f.delFree(atom+1, rightFree)
+			if newatoms < 1+rightFree {
+				f.addFree(atom+newatoms, 1+rightFree-newatoms)
+			}
+		}
+		write(atom)
+		f.freeChunks(target)
+		f.free(target)
+		return atom
+	}
 
-				if newtarget != target {
-					Handle(newtarget).Put(buf)
-					f.write(buf, atom<<4+1)
-				}
+	f.freeChunks(atom)
+	if newatoms > oldatoms {
+		if rightFree := f.checkRight(atom, oldatoms); rightFree > 0 && newatoms <= oldatoms+rightFree {
+			f.delFree(atom+oldatoms, rightFree)
+			if newatoms < oldatoms+rightFree {
+				f.addFree(atom+newatoms, oldatoms+rightFree-newatoms)
 			}
+			write(atom)
+			return atom
 		}
-		return
-	})
-	return
+
+		if !keepHandle {
+			f.free(atom)
+			return f.alloc(newatoms, write)
+		}
+
+		// reloc
+		buf := make([]byte, 16)
+		buf[0] = 0xfd
+		Handle(f.alloc(newatoms, write)).Put(buf[1:])
+		newatoms, write = 1, func(atom int64) { f.write(buf, atom<<4) }
+	}
+
+	if newatoms < oldatoms { // in place shrink
+		rightFree := f.checkRight(atom, oldatoms)
+		if rightFree > 0 { // right join
+			f.delFree(atom+oldatoms, rightFree)
+		}
+		f.addFree(atom+newatoms, oldatoms+rightFree-newatoms)
+	}
+	write(atom)
+	return atom
 }
 
 // Lock locks f for writing. If the lock is already locked for reading or writing,
@@ -0,0 +1,87 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package falloc
+
+import (
+	"sort"
+)
+
+// Free lists table types, see docs.go.
+const (
+	FLTTExact = iota // Free lists of blocks of 1, 2, 3, ..., 3855 and 3856+ atoms.
+	FLTTPow2         // Free lists of blocks of 1, 2, 4, ..., 2048 and 3856+ atoms.
+	FLTTFib          // Free lists of blocks of 1, 2, 3, 5, ..., 2584 and 3856+ atoms.
+)
+
+// flttClasses are the sizes of the free lists of the FLTT types. The last
+// size of every FLTT type is 3856, the largest possible allocation request.
+// No table content ends at an atom end, thus the table items are never
+// escaped.
+var flttClasses [][]int64
+
+func init() {
+	var exact, pow2, fib []int64
+	for i := int64(1); i < 3856; i++ {
+		exact = append(exact, i)
+	}
+	for i := int64(1); i < 3856; i <<= 1 {
+		pow2 = append(pow2, i)
+	}
+	for a, b := int64(1), int64(2); a < 3856; a, b = b, a+b {
+		fib = append(fib, a)
+	}
+	for _, v := range [][]int64{exact, pow2, fib} {
+		flttClasses = append(flttClasses, append(v, 3856))
+	}
+}
+
+// header returns the header block of a File having FLTT fltt.
+func header(fltt byte) []byte {
+	b := append([]byte(nil), hdr...)
+	b[15] = fltt
+	return b
+}
+
+// setFLTT sets the type of the free lists table of f. It returns false if
+// fltt is not a supported FLTT type.
+func (f *File) setFLTT(fltt byte) bool {
+	if int(fltt) >= len(flttClasses) {
+		return false
+	}
+
+	f.fltt, f.classes = fltt, flttClasses[fltt]
+	return true
+}
+
+// index returns the index of the free list of blocks of at least size atoms
+// in the free lists table.
+func (f *File) index(size int64) int {
+	return sort.Search(len(f.classes), func(i int) bool { return f.classes[i] > size }) - 1
+}
+
+// class returns the size of the free list a free block of atoms belongs to.
+func (f *File) class(atoms int64) int64 {
+	return f.classes[f.index(atoms)]
+}
+
+// item returns the file offset of the address field of the free lists table
+// item of size.
+func (f *File) item(size int64) int64 {
+	ofs := int64(2<<4 + 1)
+	if 14*len(f.classes) > 237 {
+		ofs += 2
+	}
+	return ofs + 14*int64(f.index(size)) + 7
+}
+
+// table returns the content of the free lists table block.
+func (f *File) table() []byte {
+	b := make([]byte, 14*len(f.classes))
+	for i, size := range f.classes {
+		Handle(size).Put(b[14*i:])
+		Handle(f.freetab[size]).Put(b[14*i+7:])
+	}
+	return b
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package falloc
+
+import (
+	"github.com/cznic/fileutil/storage"
+)
+
+// setPunch sets the minimum size of free blocks to punch holes in to bytes.
+func (f *File) setPunch(bytes int64) {
+	switch {
+	case bytes <= 0:
+		f.punch = 0
+	case bytes < 4<<4: // at least one interior atom
+		f.punch = 4
+	default:
+		f.punch = (bytes + 15) >> 4
+	}
+}
+
+// punchHoles deallocates the interior of the free blocks recorded by makeFree
+// in the last update and still free. Punching holes is only an optimization,
+// errors are ignored.
+func (f *File) punchHoles() {
+	p, ok := f.f.(storage.PunchHoler)
+	if !ok {
+		return
+	}
+
+	for atom, atoms := range f.punches {
+		if atom+atoms > f.atoms {
+			continue
+		}
+
+		p.PunchHole((atom+2)<<4, (atoms-3)<<4)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package falloc
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/cznic/fileutil/storage"
+)
+
+// RepairReport is the result of Repair.
+type RepairReport struct {
+	Atoms      int64       // File size in atoms after the repair.
+	UsedBlocks int64       // Number of used blocks, including relocations.
+	FreeBlocks int64       // Number of free blocks after the repair.
+	Fixes      []Violation // Every fix made, ordered by atom address.
+}
+
+func (r *RepairReport) fix(atom int64, format string, arg ...interface{}) {
+	r.Fixes = append(r.Fixes, Violation{atom, fmt.Sprintf(format, arg...)})
+}
+
+// Repair salvages a damaged store. The type of its free lists table is taken
+// from the header or, if the header is damaged, guessed from the size of the
+// free lists table block, defaulting to FLTT 0. Repair scans
+// all blocks of store linearly, merges adjacent free blocks, rebuilds the
+// headers and tails of all free blocks, links them into a freshly written free
+// lists table and truncates any trailing free space. Repair never modifies
+// used blocks, if some of them cannot be parsed Repair fails with ECorrupted
+// and store is left untouched, provided it is a storage.Rollbacker.
+//
+// Repair returns a report listing every fix made and an error, if any. On
+// success store can be opened by Open.
+func Repair(store storage.Accessor) (r *RepairReport, err error) {
+	r = &RepairReport{}
+	if err = storage.Mutate(store, func() (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				err = e.(error)
+			}
+		}()
+
+		fi, err := store.Stat()
+		if err != nil {
+			return &EOpen{store.Name(), err}
+		}
+
+		f := &File{f: store, atoms: fi.Size() >> 4}
+		f.setFLTT(repairFLTT(store))
+		f.canfree = 2 + rq2Atoms(14*len(f.classes))
+		if fi.Size() < f.canfree<<4 {
+			return &ESize{store.Name(), fi.Size()}
+		}
+
+		if fi.Size()&0xf != 0 {
+			if err = store.Truncate(f.atoms << 4); err != nil {
+				return
+			}
+
+			r.fix(f.atoms, "file size %#x truncated to a multiple of the atom size", fi.Size())
+		}
+
+		f.repair(r)
+		return
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Stable(violations(r.Fixes))
+	return
+}
+
+// repairFLTT returns the free lists table type of store.
+func repairFLTT(store storage.Accessor) byte {
+	b := make([]byte, 2<<4+3)
+	if n, _ := store.ReadAt(b, 0); n != len(b) {
+		return FLTTExact
+	}
+
+	if fltt := b[15]; bytes.Equal(b[:15], hdr[:15]) && int(fltt) < len(flttClasses) {
+		return fltt
+	}
+
+	n := int64(b[2<<4])
+	if n == 0xfc {
+		n = int64(b[2<<4+1])<<8 | int64(b[2<<4+2])
+	}
+	for fltt, classes := range flttClasses {
+		if n == int64(14*len(classes)) {
+			return byte(fltt)
+		}
+	}
+	return FLTTExact
+}
+
+type repairFree struct {
+	atom, size int64
+}
+
+func (f *File) repair(r *RepairReport) {
+	b, h := make([]byte, len(hdr)), header(f.fltt)
+	if f.read(b, 0); !bytes.Equal(b, h) {
+		f.write(h, 0)
+		r.fix(0, "header rewritten")
+	}
+
+	if tag, size := f.getInfo(1); tag >= 0xfe || size != 1 {
+		panic(&ECorrupted{f.f.Name(), 1 << 4})
+	}
+
+	// Linear scan, starting after the free lists table.
+	var free []repairFree
+	for atom := f.canfree; atom < f.atoms; {
+		tag, size := f.getInfo(atom)
+		if tag == 0xfe {
+			size = f.repairSize(r, atom, size)
+		}
+		if atom+size > f.atoms {
+			panic(&ECorrupted{f.f.Name(), atom << 4})
+		}
+
+		switch n := len(free); {
+		case tag < 0xfe:
+			r.UsedBlocks++
+		case n != 0 && free[n-1].atom+free[n-1].size == atom:
+			free[n-1].size += size
+			r.fix(atom, "free block merged with the free block @%#x", free[n-1].atom)
+		default:
+			free = append(free, repairFree{atom, size})
+		}
+		atom += size
+	}
+
+	// Trailing free space.
+	if n := len(free); n != 0 && free[n-1].atom+free[n-1].size == f.atoms {
+		last := free[n-1]
+		free = free[:n-1]
+		f.atoms = last.atom
+		if err := f.f.Truncate(f.atoms << 4); err != nil {
+			panic(&EWrite{f.f.Name(), f.atoms << 4, err})
+		}
+
+		r.fix(last.atom, "trailing free space of %d atoms truncated", last.size)
+	}
+
+	// Free lists.
+	f.freetab, f.punches = [len(f.freetab)]int64{}, nil
+	lists := make([][]int64, len(f.classes))
+	sizes := map[int64]int64{}
+	for _, v := range free {
+		i := f.index(v.size)
+		lists[i] = append(lists[i], v.atom)
+		sizes[v.atom] = v.size
+	}
+	head, tail := make([]byte, 22), make([]byte, 8)
+	for k, list := range lists {
+		for i, atom := range list {
+			var prev, next int64
+			if i > 0 {
+				prev = list[i-1]
+			}
+			if i < len(list)-1 {
+				next = list[i+1]
+			}
+			atoms := sizes[atom]
+			h, t := head[:16], tail[:0]
+			if atoms > 1 {
+				h, t = head, tail
+			}
+			f.read(h, atom<<4)
+			f.read(t, (atom+atoms)<<4-8)
+			h, t = append([]byte(nil), h...), append([]byte(nil), t...)
+			f.makeFree(prev, atom, atoms, next)
+			f.read(head[:len(h)], atom<<4)
+			f.read(tail[:len(t)], (atom+atoms)<<4-8)
+			if !bytes.Equal(h, head[:len(h)]) || !bytes.Equal(t, tail[:len(t)]) {
+				r.fix(atom, "free block of %d atoms rebuilt", atoms)
+			}
+		}
+		if len(list) != 0 {
+			f.freetab[f.classes[k]] = list[0]
+		}
+	}
+
+	// Free lists table.
+	old := f.oldTable()
+	if b = f.table(); !bytes.Equal(old, b) {
+		f.writeUsed(b, 2)
+		r.fix(2, "free lists table rebuilt")
+	}
+
+	r.Atoms = f.atoms
+	r.FreeBlocks = int64(len(free))
+}
+
+// repairSize returns the size of the free block @atom having head size
+// field size. If the head size doesn't agree with the tail size, the size is
+// recovered from the nearest matching tail.
+func (f *File) repairSize(r *RepairReport, atom, size int64) int64 {
+	b := make([]byte, 8)
+	tail := func(end int64) bool {
+		f.read(b, end<<4-8)
+		var sz int64
+		(*Handle)(&sz).Get(b)
+		return b[7] == 0xfe && sz == end-atom
+	}
+
+	if size >= 2 && atom+size <= f.atoms && tail(atom+size) {
+		return size
+	}
+
+	for end := atom + 2; end <= f.atoms; end++ {
+		if tail(end) {
+			r.fix(atom, "free block size %d recovered from its tail", end-atom)
+			return end - atom
+		}
+	}
+
+	panic(&ECorrupted{f.f.Name(), atom<<4 + 15})
+}
+
+// oldTable returns the content of the free lists table block, if it can be
+// read.
+func (f *File) oldTable() (b []byte) {
+	defer func() {
+		recover()
+	}()
+
+	b, _ = f.readUsed(2)
+	return
+}
@@ -0,0 +1,288 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package falloc
+
+import (
+	"io"
+)
+
+// segment is a contiguous part of block content in the store. If esc is true,
+// the last byte of the segment is stored escaped, ie. decremented by 0xfe.
+type segment struct {
+	off, n int64
+	esc    bool
+}
+
+// segment returns the content segment of the used block @atom, which must not
+// be a relocated or an extent block.
+func (f *File) segment(atom int64) (s segment) {
+	b, ofs := make([]byte, 2), atom<<4
+	f.read(b[:1], ofs)
+	switch pre := int64(b[0]); {
+	default:
+		panic(&ECorrupted{f.f.Name(), ofs})
+	case pre == 0x00: // Empty block
+	case pre >= 1 && pre <= 237: // Short
+		s = segment{ofs + 1, pre, false}
+	case pre >= 0xee && pre <= 0xfb: // Short esc
+		s = segment{ofs + 1, 15 + 16*(pre-0xee), true}
+	case pre == 0xfc: // Long
+		f.read(b, ofs+1)
+		switch n := int64(b[0])<<8 + int64(b[1]); {
+		default:
+			panic(&ECorrupted{f.f.Name(), ofs + 1})
+		case n >= 238 && n <= 61680: // Long non esc
+			s = segment{ofs + 3, n, false}
+		case n >= 61681: // Long esc
+			s = segment{ofs + 3, 13 + 16*(n-0xf0f1), true}
+		}
+	}
+	return
+}
+
+// segments returns the content segments of the used block @atom.
+func (f *File) segments(atom int64) (segs []segment, l int64) {
+	if pre, _ := f.getInfo(atom); pre == 0xfd {
+		if atom = f.target(atom); atom < f.canfree || atom >= f.atoms {
+			panic(&ECorrupted{f.f.Name(), atom << 4})
+		}
+
+		if pre, _ := f.getInfo(atom); pre >= 0xfd {
+			panic(&ECorrupted{f.f.Name(), atom << 4})
+		}
+	}
+
+	l, chunks := f.extent(atom)
+	if l < 0 {
+		s := f.segment(atom)
+		return []segment{s}, s.n
+	}
+
+	var n int64
+	for _, h := range chunks {
+		if h < f.canfree || h >= f.atoms {
+			panic(&ECorrupted{f.f.Name(), atom << 4})
+		}
+
+		if pre, _ := f.getInfo(h); pre >= 0xfd || f.isExtent(h) {
+			panic(&ECorrupted{f.f.Name(), h << 4})
+		}
+
+		s := f.segment(h)
+		if s.n != maxBlock && s.n != l-n {
+			panic(&ECorrupted{f.f.Name(), h << 4})
+		}
+
+		segs = append(segs, s)
+		n += s.n
+	}
+	if n != l {
+		panic(&ECorrupted{f.f.Name(), atom << 4})
+	}
+
+	return
+}
+
+// reader reads the content of a block from the store.
+type reader struct {
+	f    *File
+	segs []segment
+	size int64
+	pos  int64
+}
+
+// OpenReader returns an io.ReadSeeker of the data associated with handle and
+// an error if any. Unlike Read, the data are not loaded up front but read from
+// the store on demand, thus the reader is valid only until the next
+// modification of f. Callers sharing f with other goroutines must hold its read
+// lock while using the reader. Passing an invalid handle to OpenReader may
+// return invalid data without error.
+func (f *File) OpenReader(handle Handle) (r io.ReadSeeker, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			r = nil
+			err = e.(error)
+		}
+	}()
+
+	switch handle {
+	case 0:
+		panic(ENullHandle(f.f.Name()))
+	case 2:
+		panic(&EHandle{f.f.Name(), handle})
+	}
+
+	segs, size := f.segments(int64(handle))
+	return &reader{f: f, segs: segs, size: size}, nil
+}
+
+// Read implements io.Reader.
+func (r *reader) Read(b []byte) (n int, err error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	pos := int64(0)
+	for _, s := range r.segs {
+		if len(b) == 0 {
+			break
+		}
+
+		if r.pos >= pos+s.n {
+			pos += s.n
+			continue
+		}
+
+		rel := r.pos - pos
+		m := s.n - rel
+		if m > int64(len(b)) {
+			m = int64(len(b))
+		}
+		if k, e := r.f.f.ReadAt(b[:m], s.off+rel); int64(k) != m {
+			return n, &ERead{r.f.f.Name(), s.off + rel, e}
+		}
+
+		if s.esc && rel+m == s.n {
+			b[m-1] += 0xfe
+		}
+		b = b[m:]
+		n += int(m)
+		r.pos += m
+		pos += s.n
+	}
+	return
+}
+
+// Seek implements io.Seeker.
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.pos, &EBadRequest{r.f.f.Name(), whence}
+	}
+	if offset < 0 {
+		return r.pos, &EBadRequest{r.f.f.Name(), int(offset)}
+	}
+
+	r.pos = offset
+	return offset, nil
+}
+
+// Writer is an io.WriteCloser storing the written data in a newly allocated
+// block of a File. Data are stored as they come in chunks of at most 61680
+// bytes, the handle of the block is allocated by Close. Writer methods modify
+// the File, callers sharing the File with other goroutines must hold its write
+// lock while using the Writer.
+//
+// Every chunk is stored by its own update, so the data need not be kept in
+// memory, eg. by a WAL, until Close. The price is that a Writer which is never
+// closed, eg. because the process crashed in the middle of the stream, leaks
+// the chunks it already stored. They stay allocated and no handle refers to
+// them, so they cannot be freed later.
+type Writer struct {
+	f      *File
+	buf    []byte
+	chunks []int64
+	n      int64
+	handle Handle
+	closed bool
+	err    error
+}
+
+// NewWriter returns a new Writer of f. The Writer must be closed, otherwise
+// the data it already stored are leaked, see Writer.
+func (f *File) NewWriter() *Writer {
+	return &Writer{f: f}
+}
+
+// Write implements io.Writer. If Write fails, all subsequent Write calls
+// return the same error and Close frees the data written so far.
+func (w *Writer) Write(b []byte) (n int, err error) {
+	if w.closed {
+		return 0, EClosed(w.f.f.Name())
+	}
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	for len(b) != 0 {
+		if len(w.buf) == maxBlock {
+			if w.err = w.flush(); w.err != nil {
+				return n, w.err
+			}
+		}
+
+		m := maxBlock - len(w.buf)
+		if m > len(b) {
+			m = len(b)
+		}
+		w.buf = append(w.buf, b[:m]...)
+		b = b[m:]
+		n += m
+	}
+	return
+}
+
+// flush stores the buffered data as a chunk of an extent block.
+func (w *Writer) flush() error {
+	f := w.f
+	l := w.n + int64(len(w.buf))
+	if extentAtoms(l) > 3856 {
+		return &EBadRequest{f.f.Name(), int(l)}
+	}
+
+	return f.mutate(func() (err error) {
+		w.chunks = append(w.chunks, f.alloc(rq2Atoms(len(w.buf)), func(atom int64) { f.writeUsed(w.buf, atom) }))
+		w.n = l
+		w.buf = w.buf[:0]
+		return
+	})
+}
+
+// Close implements io.Closer. It allocates the block holding all the data
+// written and returns an error if any. The handle of the block is available
+// from Handle after Close returns successfully.
+func (w *Writer) Close() (err error) {
+	if w.closed {
+		return EClosed(w.f.f.Name())
+	}
+
+	w.closed = true
+	f := w.f
+	if len(w.chunks) == 0 && w.err == nil {
+		w.handle, err = f.Alloc(w.buf)
+		return
+	}
+
+	if w.err == nil {
+		w.err = w.flush()
+	}
+	if w.err == nil {
+		w.err = f.mutate(func() (err error) {
+			w.handle = Handle(f.alloc(f.encodeExtent(w.n, w.chunks)))
+			return
+		})
+	}
+	if err = w.err; err != nil {
+		f.mutate(func() error {
+			for _, h := range w.chunks {
+				f.free(h)
+			}
+			return nil
+		})
+	}
+	return
+}
+
+// Handle returns the handle of the data written by w. It's valid only after
+// Close returned successfully.
+func (w *Writer) Handle() Handle {
+	return w.handle
+}
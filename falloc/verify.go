@@ -0,0 +1,457 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package falloc
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Violation describes a single violation of the file format rules found by
+// Verify.
+type Violation struct {
+	Atom int64  // Atom address of the offending block.
+	Msg  string // Description of the violation.
+}
+
+func (v *Violation) String() string {
+	return fmt.Sprintf("@%#x: %s", v.Atom, v.Msg)
+}
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	Atoms      int64       // File size in atoms.
+	UsedBlocks int64       // Number of used blocks, including relocations.
+	FreeBlocks int64       // Number of free blocks.
+	FreeAtoms  int64       // Total size of free blocks in atoms.
+	Violations []Violation // All violations found, ordered by atom address.
+}
+
+// OK returns whether no violations were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Violations) == 0
+}
+
+type verifier struct {
+	*File
+	extents map[int64]int64 // extent block atom -> content length
+	free    map[int64]int64 // free block atom -> size
+	onlist  map[int64]int64 // free block atom -> the free list it was found on
+	r       *VerifyReport
+	refs    map[int64]int64 // relocation target or chunk -> referring block
+	size    int64           // store size in bytes
+	used    map[int64]byte  // used block atom -> tag
+}
+
+func (v *verifier) violation(atom int64, format string, arg ...interface{}) {
+	v.r.Violations = append(v.r.Violations, Violation{atom, fmt.Sprintf(format, arg...)})
+}
+
+// Verify walks all of the blocks and all of the free lists of f and checks
+// them against the rules described in the package documentation. That
+// includes the escaping of used blocks, relocations pointing to used non
+// relocated blocks, extent chunks being used blocks of proper size referred to
+// only once, agreement of the head and tail sizes of free blocks, the
+// doubly linked structure of the free lists and that every free block is
+// properly merged with its free neighbours and found on exactly one,
+// appropriate free list.
+//
+// Verify returns a report listing every violation found and an error, if any.
+// The error reports a failure preventing the verification, e.g. a read error,
+// violations of the format rules are not errors in this sense.
+func (f *File) Verify() (r *VerifyReport, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			r = nil
+			err = e.(error)
+		}
+	}()
+
+	fi, err := f.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &verifier{
+		File:    f,
+		extents: map[int64]int64{},
+		free:    map[int64]int64{},
+		onlist:  map[int64]int64{},
+		refs:    map[int64]int64{},
+		r:       &VerifyReport{Atoms: fi.Size() >> 4},
+		size:    fi.Size(),
+		used:    map[int64]byte{},
+	}
+	if v.size&0xf != 0 {
+		v.violation(v.r.Atoms, "file size %#x is not a multiple of the atom size", v.size)
+	}
+
+	if v.r.Atoms != f.atoms {
+		v.violation(v.r.Atoms, "file size is %d atoms, expected %d", v.r.Atoms, f.atoms)
+	}
+
+	v.header()
+	v.blocks()
+	v.relocs()
+	v.chunks()
+	v.lists()
+	sort.Stable(violations(v.r.Violations))
+	return v.r, nil
+}
+
+// LockedVerify wraps Verify in a RLock/RUnlock pair.
+func (f *File) LockedVerify() (r *VerifyReport, err error) {
+	f.RLock()
+	defer f.RUnlock()
+	return f.Verify()
+}
+
+// rd reads len(b) bytes at atom address atom plus ofs, clipped at the end of
+// the store. It returns the number of bytes read.
+func (v *verifier) rd(b []byte, atom, ofs int64) int {
+	off := atom<<4 + ofs
+	if n := v.size - off; n < int64(len(b)) {
+		if n <= 0 {
+			return 0
+		}
+
+		b = b[:n]
+	}
+	v.read(b, off)
+	return len(b)
+}
+
+func (v *verifier) header() {
+	b := make([]byte, len(hdr))
+	if n := v.rd(b, 0, 0); n != len(b) || string(b) != string(header(v.fltt)) {
+		v.violation(0, "invalid header [% x]", b[:n])
+	}
+}
+
+// blocks performs the linear scan of all blocks.
+func (v *verifier) blocks() {
+	b := make([]byte, 22)
+	tail := make([]byte, 8)
+	prevFree := false
+	for atom := int64(0); atom < v.r.Atoms; {
+		n := v.rd(b, atom, 0)
+		tag, size := b[0], int64(1)
+		switch {
+		case tag <= 0xed:
+			size = rq2Atoms(int(tag))
+		case tag <= 0xfb:
+			size = rq2Atoms(15 + 16*int(tag-0xee))
+		case tag == 0xfc:
+			switch n := int(b[1])<<8 | int(b[2]); {
+			case n == 0:
+				var l int64
+				(*Handle)(&l).Get(b[3:])
+				if l <= maxBlock {
+					v.violation(atom, "extent block of invalid content length %d", l)
+					return
+				}
+
+				size = extentAtoms(l)
+				v.extents[atom] = l
+			case n < 238:
+				v.violation(atom, "used long block of invalid content length %d", n)
+				return
+			case n <= 61680:
+				size = rq2Atoms(n)
+			default:
+				size = rq2Atoms(13 + 16*(n-0xf0f1))
+			}
+		case tag == 0xfe:
+			if n < 22 {
+				v.violation(atom, "truncated free block")
+				return
+			}
+
+			(*Handle)(&size).Get(b[15:])
+			if size < 2 {
+				v.violation(atom, "free block of invalid size %d", size)
+				return
+			}
+		}
+		if atom+size > v.r.Atoms {
+			v.violation(atom, "block of %d atoms extends beyond the end of file", size)
+			return
+		}
+
+		v.rd(tail, atom+size-1, 8)
+		last := tail[7]
+		switch {
+		case tag == 0:
+			if last != 0 {
+				v.violation(atom, "last byte %#02x of a used empty block is not 0x00", last)
+			}
+		case tag == 0xfd:
+			if last != 0 {
+				v.violation(atom, "last byte %#02x of a relocated block is not 0x00", last)
+			}
+		case tag <= 0xed:
+			v.usedEnd(atom, last, int(tag)+1, "used short block")
+		case tag <= 0xfb || tag == 0xfc && int(b[1])<<8|int(b[2]) > 61680:
+			if last > 1 {
+				v.violation(atom, "last byte %#02x of an escaped block is not 0x00 or 0x01", last)
+			}
+		case tag == 0xfc && b[1] == 0 && b[2] == 0:
+			if last != 0 {
+				v.violation(atom, "last byte %#02x of an extent block is not 0x00", last)
+			}
+		case tag == 0xfc:
+			v.usedEnd(atom, last, int(b[1])<<8|int(b[2])+3, "used long block")
+		case tag == 0xfe:
+			var tsize int64
+			(*Handle)(&tsize).Get(tail)
+			switch {
+			case last != 0xfe:
+				v.violation(atom, "last byte %#02x of a free block is not 0xfe", last)
+			case tsize != size:
+				v.violation(atom, "free block head size %d and tail size %d disagree", size, tsize)
+			}
+		case tag == 0xff:
+			if last != 0xff {
+				v.violation(atom, "last byte %#02x of a free atom is not 0xff", last)
+			}
+		}
+
+		isFree := tag >= 0xfe
+		switch {
+		case isFree:
+			if atom < v.canfree {
+				v.violation(atom, "free block below the first freeable atom %#x", v.canfree)
+			}
+
+			if prevFree {
+				v.violation(atom, "free block not merged with its left free neighbour")
+			}
+
+			v.free[atom] = size
+			v.r.FreeBlocks++
+			v.r.FreeAtoms += size
+		default:
+			v.used[atom] = tag
+			v.r.UsedBlocks++
+		}
+		prevFree = isFree
+		atom += size
+	}
+}
+
+// usedEnd checks the last byte of a non escaped used block having content
+// ending at block offset end.
+func (v *verifier) usedEnd(atom int64, last byte, end int, kind string) {
+	switch {
+	case end&0xf == 0:
+		if last >= 0xfe {
+			v.violation(atom, "content of a %s ends in %#02x and is not escaped", kind, last)
+		}
+	case last != 0:
+		v.violation(atom, "last byte %#02x of a %s is not 0x00", last, kind)
+	}
+}
+
+// relocs checks the targets of all relocated blocks.
+func (v *verifier) relocs() {
+	b := make([]byte, 7)
+	for atom, tag := range v.used {
+		if tag != 0xfd {
+			continue
+		}
+
+		var target int64
+		v.rd(b, atom, 1)
+		(*Handle)(&target).Get(b)
+		switch ttag, ok := v.used[target]; {
+		case !ok:
+			if _, ok := v.free[target]; ok {
+				v.violation(atom, "relocation to the free block @%#x", target)
+				break
+			}
+
+			v.violation(atom, "relocation to @%#x, not a block", target)
+		case ttag == 0xfd:
+			v.violation(atom, "relocation to the relocated block @%#x", target)
+		default:
+			v.ref(atom, target)
+		}
+	}
+}
+
+// ref records a reference of block @atom to target.
+func (v *verifier) ref(atom, target int64) {
+	if prev, ok := v.refs[target]; ok {
+		v.violation(atom, "block @%#x is referred to by @%#x as well", target, prev)
+		return
+	}
+
+	v.refs[target] = atom
+}
+
+// chunks checks the chunks of all extent blocks.
+func (v *verifier) chunks() {
+	b := make([]byte, 7)
+	for atom, l := range v.extents {
+		k := (l + maxBlock - 1) / maxBlock
+		for i := int64(0); i < k; i++ {
+			var chunk int64
+			v.rd(b, atom, 10+7*i)
+			(*Handle)(&chunk).Get(b)
+			if _, ok := v.used[chunk]; !ok {
+				v.violation(atom, "extent chunk #%d @%#x is not a used block", i, chunk)
+				continue
+			}
+
+			v.rd(b[:3], chunk, 0)
+			n, e := contentLen(b), int64(maxBlock)
+			if i == k-1 {
+				e = l - i*maxBlock
+			}
+			if n != e {
+				v.violation(atom, "extent chunk #%d @%#x has content length %d, expected %d", i, chunk, n, e)
+				continue
+			}
+
+			v.ref(atom, chunk)
+		}
+	}
+}
+
+// contentLen returns the content length of a used non relocated block having
+// first bytes b or -1 if the block is not such block.
+func contentLen(b []byte) int64 {
+	switch tag := int64(b[0]); {
+	case tag <= 0xed:
+		return tag
+	case tag <= 0xfb:
+		return 15 + 16*(tag-0xee)
+	case tag == 0xfc:
+		switch n := int64(b[1])<<8 | int64(b[2]); {
+		case n >= 238 && n <= maxBlock:
+			return n
+		case n > maxBlock:
+			return 13 + 16*(n-0xf0f1)
+		}
+	}
+	return -1
+}
+
+type violations []Violation
+
+func (x violations) Len() int           { return len(x) }
+func (x violations) Less(i, j int) bool { return x[i].Atom < x[j].Atom }
+func (x violations) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+// lists checks the free lists table and walks all of the free lists.
+func (v *verifier) lists() {
+	tag, ok := v.used[2]
+	if !ok || tag == 0xfd {
+		v.violation(2, "free lists table is not a used block")
+		return
+	}
+
+	b, ok := v.table()
+	if !ok {
+		return
+	}
+
+	if len(b) != 14*len(v.classes) {
+		v.violation(2, "free lists table has %d bytes, expected %d", len(b), 14*len(v.classes))
+		return
+	}
+
+	var sizes []int64
+	heads := map[int64]int64{}
+	for i := 0; i < len(b); i += 14 {
+		var size, head int64
+		(*Handle)(&size).Get(b[i:])
+		(*Handle)(&head).Get(b[i+7:])
+		if size == 0 {
+			continue
+		}
+
+		if size > 3856 || v.class(size) != size {
+			v.violation(2, "free lists table item #%d: invalid size %d for FLTT %d", i/14, size, v.fltt)
+			continue
+		}
+
+		if _, ok := heads[size]; ok {
+			v.violation(2, "free lists table item #%d: duplicate size %d", i/14, size)
+			continue
+		}
+
+		heads[size] = head
+		sizes = append(sizes, size)
+	}
+	sort.Sort(int64s(sizes))
+	for _, size := range sizes {
+		v.list(size, heads[size], sizes)
+	}
+	for atom, size := range v.free {
+		if _, ok := v.onlist[atom]; !ok {
+			v.violation(atom, "free block of %d atoms not on any free list", size)
+		}
+	}
+}
+
+// table returns the content of the free lists table. A table which cannot be
+// decoded is reported as a violation.
+func (v *verifier) table() (b []byte, ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			x, isCorrupted := e.(*ECorrupted)
+			if !isCorrupted {
+				panic(e)
+			}
+
+			v.violation(2, "free lists table is damaged @%#x", x.Ofs)
+			b, ok = nil, false
+		}
+	}()
+
+	b, _ = v.readUsed(2)
+	return b, true
+}
+
+// list walks the free list of blocks of at least size atoms.
+func (v *verifier) list(size, atom int64, sizes []int64) {
+	b := make([]byte, 14)
+	var prev int64
+	for atom != 0 {
+		bsize, ok := v.free[atom]
+		if !ok {
+			v.violation(atom, "free list %d item is not a free block", size)
+			return
+		}
+
+		if l, ok := v.onlist[atom]; ok {
+			v.violation(atom, "free block found again on free list %d, first found on free list %d", size, l)
+			return
+		}
+
+		v.onlist[atom] = size
+		i := sort.Search(len(sizes), func(i int) bool { return sizes[i] > bsize }) - 1
+		if i < 0 || sizes[i] != size {
+			v.violation(atom, "free block of %d atoms on free list %d", bsize, size)
+		}
+
+		var p, next int64
+		v.rd(b, atom, 1)
+		(*Handle)(&p).Get(b)
+		(*Handle)(&next).Get(b[7:])
+		if p != prev {
+			v.violation(atom, "free list %d: prev link %#x, expected %#x", size, p, prev)
+		}
+
+		prev, atom = atom, next
+	}
+}
+
+type int64s []int64
+
+func (x int64s) Len() int           { return len(x) }
+func (x int64s) Less(i, j int) bool { return x[i] < x[j] }
+func (x int64s) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
@@ -0,0 +1,85 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fileutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFallocate(t *testing.T) {
+	file, err := ioutil.TempFile("", "fallocate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	buf := bytes.Repeat([]byte{0xa5}, 1<<12)
+	if _, err = file.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	size := func() int64 {
+		fi, err := file.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return fi.Size()
+	}
+
+	if err = Fallocate(file, FALLOC_FL_DEFAULT, 0, 1<<14); err != nil {
+		t.Fatal(10, err)
+	}
+
+	if g, e := size(), int64(1<<14); g != e {
+		t.Fatal(20, g, e)
+	}
+
+	if err = Fallocate(file, FALLOC_FL_KEEP_SIZE, 1<<14, 1<<14); err != nil {
+		t.Fatal(30, err)
+	}
+
+	zeroErr := Fallocate(file, FALLOC_FL_ZERO_RANGE|FALLOC_FL_KEEP_SIZE, 1<<10, 1<<15)
+	if zeroErr != nil && zeroErr != ErrUnsupported {
+		t.Fatal(40, zeroErr)
+	}
+
+	if g, e := size(), int64(1<<14); g != e {
+		t.Fatal(50, g, e)
+	}
+
+	b := make([]byte, 1<<14)
+	if _, err = file.ReadAt(b, 0); err != nil {
+		t.Fatal(60, err)
+	}
+
+	e := make([]byte, 1<<14)
+	copy(e, buf)
+	if zeroErr == nil {
+		e = make([]byte, 1<<14)
+		copy(e, buf[:1<<10])
+	}
+	if !bytes.Equal(b, e) {
+		t.Fatal(70)
+	}
+
+	if err = Fallocate(file, FALLOC_FL_COLLAPSE_RANGE|FALLOC_FL_INSERT_RANGE, 0, 1<<12); err == nil {
+		t.Fatal(80)
+	}
+
+	// The portable version.
+	if err = fallocate(file, FALLOC_FL_KEEP_SIZE, 1<<14, 1<<14); err != nil {
+		t.Fatal(90, err)
+	}
+
+	if g, e := size(), int64(1<<14); g != e {
+		t.Fatal(100, g, e)
+	}
+}
@@ -6,13 +6,21 @@
 package fileutil
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -20,8 +28,23 @@ import (
 type GoMFile struct {
 	mfile *MFile
 	mutex sync.Mutex
+
+	subMu  sync.Mutex
+	subs   map[chan MFileEvent]struct{}
+	stop   chan struct{}
+	closed bool
+}
+
+// MFileEvent is the state of a GoMFile after a modification was processed.
+type MFileEvent struct {
+	File *os.File // The file after the modification, nil if Err != nil.
+	Err  error    // The error of checking the file or of the handler.
 }
 
+// goMFilePoll is the interval of checking a GoMFile having subscribers if
+// the delta_ns parameter of NewGoMFile is zero.
+const goMFilePoll = time.Second
+
 // NewGoMFile return a newly created GoMFile.
 func NewGoMFile(fname string, flag int, perm os.FileMode, delta_ns int64) (m *GoMFile, err error) {
 	m = &GoMFile{}
@@ -49,6 +72,143 @@ func (m *GoMFile) SetHandler(h MFileHandler) {
 	m.mfile.SetHandler(h)
 }
 
+// SetCheck sets additional checks of file modification. See MFileCheck.
+func (m *GoMFile) SetCheck(checks MFileCheck) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.mfile.SetCheck(checks)
+}
+
+// SetReopenHandler sets a function to be invoked instead of the handler when
+// the modified file was reopened by path. If not set, the handler is invoked
+// with the new file.
+func (m *GoMFile) SetReopenHandler(h MFileReopenHandler) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.mfile.SetReopenHandler(h)
+}
+
+// Subscribe returns a channel receiving the state of m after every
+// modification. While m has subscribers, it's checked for modifications by a
+// background goroutine every delta_ns ns (a parameter of NewGoMFile) and
+// handler errors are sent to the subscribers instead of being returned by
+// File. The channel is buffered, a subscriber not keeping up receives only the
+// latest state. The channel is closed when ctx is done or when m is closed.
+func (m *GoMFile) Subscribe(ctx context.Context) <-chan MFileEvent {
+	ch := make(chan MFileEvent, 1)
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	if m.closed {
+		close(ch)
+		return ch
+	}
+
+	if m.subs == nil {
+		m.subs = map[chan MFileEvent]struct{}{}
+		m.stop = make(chan struct{})
+		m.mfile.setNotify(m.broadcast)
+		go m.poll(m.stop)
+	}
+	m.subs[ch] = struct{}{}
+	go func(stop chan struct{}) {
+		select {
+		case <-ctx.Done():
+			m.unsubscribe(ch)
+		case <-stop:
+		}
+	}(m.stop)
+	return ch
+}
+
+func (m *GoMFile) unsubscribe(ch chan MFileEvent) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	if _, ok := m.subs[ch]; !ok {
+		return
+	}
+
+	delete(m.subs, ch)
+	close(ch)
+	if len(m.subs) == 0 {
+		close(m.stop)
+		m.subs, m.stop = nil, nil
+		m.mfile.setNotify(nil)
+	}
+}
+
+// broadcast sends ev to all subscribers, replacing a pending older event.
+func (m *GoMFile) broadcast(ev MFileEvent) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	for ch := range m.subs {
+		select {
+		case ch <- ev:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- ev
+		}
+	}
+}
+
+// poll checks m for modifications until stop is closed.
+func (m *GoMFile) poll(stop chan struct{}) {
+	d := time.Duration(m.mfile.delta)
+	if d == 0 {
+		d = goMFilePoll
+	}
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if _, err := m.File(); err != nil {
+				m.broadcast(MFileEvent{Err: err})
+			}
+		}
+	}
+}
+
+// Close implements io.Closer. It stops checking m in the background, closes
+// the channels of all subscribers and closes the underlying MFile.
+func (m *GoMFile) Close() error {
+	m.subMu.Lock()
+	if !m.closed {
+		m.closed = true
+		if m.stop != nil {
+			close(m.stop)
+		}
+		for ch := range m.subs {
+			close(ch)
+		}
+		m.subs, m.stop = nil, nil
+		m.mfile.setNotify(nil)
+	}
+	m.subMu.Unlock()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mfile.Close()
+}
+
+// Watch delegates to MFile.Watch, it starts watching the file for changes. It
+// returns ErrUnsupported on systems without inotify.
+func (m *GoMFile) Watch() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mfile.Watch()
+}
+
+// Unwatch delegates to MFile.Unwatch, it stops watching the file for changes.
+func (m *GoMFile) Unwatch() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mfile.Unwatch()
+}
+
 // MFileHandler resolves modifications of File.
 // Possible File context is expected to be a part of the handler's closure.
 type MFileHandler func(*os.File) error
@@ -58,19 +218,58 @@ type MFileHandler func(*os.File) error
 // and have to be reloaded in such event prior to performing something configurable by that
 // file. The checks are made only on access to the MFile file by
 // File() and a time threshold/hysteresis value can be chosen on creating a new MFile.
+// Alternatively, changes can be watched for, see Watch. An MFile no longer
+// used should be closed.
 type MFile struct {
+	mu      sync.Mutex
 	file    *os.File
+	name    string
+	flag    int
+	perm    os.FileMode
 	handler MFileHandler
 	t0      int64
 	delta   int64
 	ctime   int64
+	watch   io.Closer
+	err     error // Of an asynchronously invoked handler.
+
+	checks        MFileCheck
+	reopenHandler MFileReopenHandler
+	size          int64
+	sum           []byte
+	notify        atomic.Value // func(MFileEvent)
+	closed        bool
 }
 
+// MFileCheck selects additional checks of MFile modification. By default a
+// modification is detected by a change of the file modification time or size.
+type MFileCheck int
+
+// MFileCheck values, may be or-ed together.
+const (
+	// Re-stat the path of the file and compare its device and inode with
+	// the opened file. On a mismatch the file was replaced, eg. by renaming
+	// another file over it, and the path is reopened.
+	MFileCheckPath MFileCheck = 1 << iota
+	// Compare a hash of the file content, a changed modification time or
+	// size alone is not a modification.
+	MFileCheckHash
+)
+
+// MFileReopenHandler resolves modifications of File which was reopened by
+// path. It gets both the old and the new file, the old file is closed after
+// the handler returns successfully.
+type MFileReopenHandler func(old, new *os.File) error
+
+// watcher starts watching m for changes, calling m.changed when a change is
+// detected, if supported by the OS. Closing the result stops the watching.
+var watcher = func(m *MFile) (io.Closer, error) { return nil, ErrUnsupported }
+
 // NewMFile returns a newly created MFile or Error if any.
 // The fname, flag and perm parameters have the same meaning as in os.Open.
 // For meaning of the delta_ns parameter please see the (m *MFile) File() docs.
 func NewMFile(fname string, flag int, perm os.FileMode, delta_ns int64) (m *MFile, err error) {
-	m = &MFile{}
+	m = &MFile{name: fname, flag: flag, perm: perm}
 	m.t0 = time.Now().UnixNano()
 	if m.file, err = os.OpenFile(fname, flag, perm); err != nil {
 		return
@@ -78,33 +277,262 @@ func NewMFile(fname string, flag int, perm os.FileMode, delta_ns int64) (m *MFil
 
 	var fi os.FileInfo
 	if fi, err = m.file.Stat(); err != nil {
+		m.file.Close()
 		return
 	}
 
-	m.ctime = fi.ModTime().UnixNano()
+	m.ctime, m.size = fi.ModTime().UnixNano(), fi.Size()
 	m.delta = delta_ns
 	runtime.SetFinalizer(m, func(m *MFile) {
+		log.Printf("fileutil: MFile %q not closed", m.name)
 		m.file.Close()
 	})
 	return
 }
 
+// ErrClosed is returned by the methods of a closed MFile, GoMFile or
+// AtomicWriter.
+var ErrClosed = errors.New("use of closed file")
+
+// Close implements io.Closer. It stops watching the file and closes it. Not
+// closed MFiles are closed by a finalizer, which logs the leak.
+func (m *MFile) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	m.closed = true
+	runtime.SetFinalizer(m, nil)
+	var err error
+	if m.watch != nil {
+		err = m.watch.Close()
+		m.watch = nil
+	}
+	if e := m.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
 // SetChanged forces next File() to unconditionally handle modification of the wrapped os.File.
 func (m *MFile) SetChanged() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.ctime = -1
 }
 
 // SetHandler sets a function to be invoked when modification of MFile is to be processed.
 func (m *MFile) SetHandler(h MFileHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.handler = h
 }
 
+// SetCheck sets additional checks of file modification. See MFileCheck.
+func (m *MFile) SetCheck(checks MFileCheck) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checks = checks
+	m.sum = nil
+	if checks&MFileCheckHash != 0 {
+		m.sum, _ = hash(m.file)
+	}
+}
+
+// SetReopenHandler sets a function to be invoked instead of the handler when
+// the modified file was reopened by path. If not set, the handler is invoked
+// with the new file.
+func (m *MFile) SetReopenHandler(h MFileReopenHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reopenHandler = h
+}
+
+// Watch starts watching the file and its directory for changes. On a change,
+// the handler is invoked immediately from a separate goroutine. If the file was
+// replaced, eg. by renaming another file over it, the path is reopened before
+// invoking the handler, see also SetReopenHandler. A handler error is returned
+// by the next File call. Watch returns ErrUnsupported if watching is not supported by the OS, File
+// then keeps polling for changes.
+func (m *MFile) Watch() (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	if m.watch != nil {
+		return
+	}
+
+	m.watch, err = watcher(m)
+	return
+}
+
+// Unwatch stops watching the file for changes, File resumes polling.
+func (m *MFile) Unwatch() (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.watch == nil {
+		return
+	}
+
+	err = m.watch.Close()
+	m.watch = nil
+	return
+}
+
+// changed processes a change detected by the watcher w. If replaced is true,
+// the path is reopened first.
+func (m *MFile) changed(w io.Closer, replaced bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.watch != w {
+		return
+	}
+
+	err := m.check(replaced)
+	if notify := m.notifier(); err != nil && notify != nil {
+		notify(MFileEvent{Err: err})
+		return
+	}
+
+	m.err = err
+}
+
+// setNotify sets a function to be invoked with the state of m after every
+// processed modification. While set, handler errors are passed to it instead
+// of being returned and the modification is considered processed.
+func (m *MFile) setNotify(f func(MFileEvent)) {
+	m.notify.Store(f)
+}
+
+func (m *MFile) notifier() func(MFileEvent) {
+	f, _ := m.notify.Load().(func(MFileEvent))
+	return f
+}
+
+// check checks the file for modification and invokes the handler if one is
+// detected. If replaced is true, or if the MFileCheckPath check finds that
+// the path no longer refers to the file, the path is reopened first.
+func (m *MFile) check(replaced bool) (err error) {
+	fi, err := m.file.Stat()
+	if err != nil {
+		return
+	}
+
+	if !replaced && m.checks&MFileCheckPath != 0 {
+		pfi, err := os.Stat(m.name)
+		if err != nil {
+			return err
+		}
+
+		replaced = !os.SameFile(fi, pfi)
+	}
+
+	f := m.file
+	if replaced {
+		if f, err = os.OpenFile(m.name, m.flag&^(os.O_CREATE|os.O_EXCL|os.O_TRUNC), m.perm); err != nil {
+			return
+		}
+
+		if fi, err = f.Stat(); err != nil {
+			f.Close()
+			return
+		}
+	}
+
+	notify := m.notifier()
+	forced := m.ctime == -1
+	modified := replaced || forced || fi.ModTime().UnixNano() != m.ctime || fi.Size() != m.size
+	var sum []byte
+	if modified && m.checks&MFileCheckHash != 0 {
+		if sum, err = hash(f); err != nil {
+			if replaced {
+				f.Close()
+			}
+			return
+		}
+
+		modified = forced || !bytes.Equal(sum, m.sum)
+	}
+
+	if modified {
+		switch {
+		case replaced && m.reopenHandler != nil:
+			err = m.reopenHandler(m.file, f)
+		case m.handler != nil:
+			err = m.handler(f)
+		case notify == nil:
+			err = fmt.Errorf("no handler set for modified file %q", m.file.Name())
+		}
+		if err != nil && notify == nil {
+			if replaced {
+				f.Close()
+			}
+			return
+		}
+	}
+
+	if replaced {
+		m.file.Close()
+		m.file = f
+	}
+	m.ctime, m.size = fi.ModTime().UnixNano(), fi.Size()
+	if sum != nil {
+		m.sum = sum
+	}
+	if modified && notify != nil {
+		ev := MFileEvent{File: m.file}
+		if err != nil {
+			ev = MFileEvent{Err: err}
+		}
+		notify(ev)
+	}
+	return nil
+}
+
+// hash returns the SHA-256 digest of the content of f.
+func hash(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if _, err = io.Copy(h, io.NewSectionReader(f, 0, fi.Size())); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
 // File returns an os.File from MFile. If time elapsed between the last invocation of this function
 // and now is at least delta_ns ns (a parameter of NewMFile) then the file is checked for
 // change/modification. For delta_ns == 0 the modification is checked w/o getting os.Time().
-// If a change is detected a handler is invoked on the MFile file.
+// If a change is detected a handler is invoked on the MFile file, see also
+// SetCheck and SetReopenHandler.
 // Any of these steps can produce an Error. If that happens the function returns nil, Error.
+// While the MFile is watched, File only returns the error, if any, of the last
+// handler invocation. After Close, File returns ErrClosed.
 func (m *MFile) File() (file *os.File, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	if err = m.err; err != nil {
+		m.err = nil
+		return nil, err
+	}
+
+	if m.watch != nil {
+		return m.file, nil
+	}
+
 	var now int64
 
 	mustCheck := m.delta == 0
@@ -114,21 +542,10 @@ func (m *MFile) File() (file *os.File, err error) {
 	}
 
 	if mustCheck { // check interval reached
-		var fi os.FileInfo
-		if fi, err = m.file.Stat(); err != nil {
-			return
+		if err = m.check(false); err != nil {
+			return nil, err
 		}
 
-		if fi.ModTime().UnixNano() != m.ctime { // modification detected
-			if m.handler == nil {
-				return nil, fmt.Errorf("no handler set for modified file %q", m.file.Name())
-			}
-			if err = m.handler(m.file); err != nil {
-				return
-			}
-
-			m.ctime = fi.ModTime().UnixNano()
-		}
 		m.t0 = now
 	}
 
@@ -169,6 +586,405 @@ const (
 	POSIX_FADV_NOREUSE                         // Data will be accessed once.
 )
 
+// readahead populates the page cache with a byte range of f.
+var readahead = readRange
+
+// readRange is the portable readahead, it reads the range.
+func readRange(f *os.File, off, len int64) error {
+	_, err := io.CopyN(ioutil.Discard, io.NewSectionReader(f, off, len), len)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// datasync commits the data of f to stable storage.
+var datasync = func(f *os.File) error { return f.Sync() }
+
+// writeBehind starts writing back the dirty pages of a byte range of f.
+var writeBehind = func(f *os.File, off, len int64) error { return nil }
+
+// Readahead populates the page cache with the byte range of f starting at off
+// and continuing for len bytes, so that subsequent reads of the range don't
+// block on disk I/O. Readahead blocks until the range is read. On Linux
+// readahead(2) is used, elsewhere the range is read and discarded.
+func Readahead(f *os.File, off, len int64) error {
+	return readahead(f, off, len)
+}
+
+// DropCache commits the data of f to stable storage and then advises the OS
+// to drop the byte range of f starting at off and continuing for len bytes
+// from the page cache, see Fadvise. If len is zero, the range extends to the
+// end of f.
+func DropCache(f *os.File, off, len int64) error {
+	if err := datasync(f); err != nil {
+		return err
+	}
+
+	return Fadvise(f, off, len, POSIX_FADV_DONTNEED)
+}
+
+// WriteBehind starts writing back the dirty pages of the byte range of f
+// starting at off and continuing for len bytes, without waiting for the
+// writes to complete, so that a later DropCache or Sync has less to wait for.
+// If len is zero, the range extends to the end of f. On Linux
+// sync_file_range(2) is used, elsewhere WriteBehind is a no op.
+func WriteBehind(f *os.File, off, len int64) error {
+	return writeBehind(f, off, len)
+}
+
+// FallocateMode is used by Fallocate.
+type FallocateMode int
+
+// FallocateMode values. FALLOC_FL_KEEP_SIZE may be or-ed with the other values.
+const (
+	// $ grep FL_ /usr/include/linux/falloc.h
+	FALLOC_FL_DEFAULT        FallocateMode = 0x00 // Allocate space, extend the file size if needed.
+	FALLOC_FL_KEEP_SIZE      FallocateMode = 0x01 // Do not change the file size.
+	FALLOC_FL_PUNCH_HOLE     FallocateMode = 0x02 // Deallocate space, requires FALLOC_FL_KEEP_SIZE.
+	FALLOC_FL_COLLAPSE_RANGE FallocateMode = 0x08 // Remove the range, shift the rest of the file down.
+	FALLOC_FL_ZERO_RANGE     FallocateMode = 0x10 // Zero the range.
+	FALLOC_FL_INSERT_RANGE   FallocateMode = 0x20 // Insert a hole, shift the rest of the file up.
+)
+
+// ErrUnsupported is returned for operations, like some Fallocate modes or
+// MFile.Watch, not supported by the OS or by the file system.
+var ErrUnsupported = errors.New("operation not supported")
+
+// fallocate is the portable version of Fallocate. It supports only
+// FALLOC_FL_DEFAULT and FALLOC_FL_ZERO_RANGE, optionally with
+// FALLOC_FL_KEEP_SIZE, by writing zeros. Space cannot be reserved beyond the
+// end of the file portably, so FALLOC_FL_KEEP_SIZE alone is a no op.
+func fallocate(f *os.File, mode FallocateMode, off, len int64) (err error) {
+	if off < 0 || len <= 0 {
+		return os.NewSyscallError("fallocate", syscall.EINVAL)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	size := fi.Size()
+	switch mode {
+	case FALLOC_FL_DEFAULT:
+		if end := off + len; end > size {
+			return zeros(f, size, end-size)
+		}
+
+		return
+	case FALLOC_FL_KEEP_SIZE:
+		return
+	case FALLOC_FL_ZERO_RANGE:
+		return zeros(f, off, len)
+	case FALLOC_FL_ZERO_RANGE | FALLOC_FL_KEEP_SIZE:
+		if off+len > size {
+			len = size - off
+		}
+		return zeros(f, off, len)
+	}
+
+	return ErrUnsupported
+}
+
+// zeros writes len zero bytes to f starting at off.
+func zeros(f *os.File, off, len int64) (err error) {
+	b := make([]byte, 1<<16)
+	for len > 0 {
+		if len < int64(cap(b)) {
+			b = b[:len]
+		}
+		if _, err = f.WriteAt(b, off); err != nil {
+			return
+		}
+
+		off += int64(cap(b))
+		len -= int64(cap(b)) // the last b may be shorter, but then the loop ends
+	}
+	return
+}
+
+// Extent is a byte range of a file. Hole extents have no storage allocated
+// and read as zeros.
+type Extent struct {
+	Off, Len int64
+	Hole     bool
+}
+
+// extents is the portable version of Extents. It reports the whole file as a
+// single data extent.
+func extents(f *os.File) ([]Extent, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() == 0 {
+		return nil, nil
+	}
+
+	return []Extent{{0, fi.Size(), false}}, nil
+}
+
+// seekExtents enumerates the extents of f using lseek with the OS specific
+// SEEK_DATA and SEEK_HOLE whence values. SEEK_DATA failing with enxio means
+// there's no more data. The file offset of f is preserved.
+func seekExtents(f *os.File, seekData, seekHole int, enxio error) (x []Extent, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if _, e := f.Seek(pos, io.SeekStart); e != nil && err == nil {
+			x, err = nil, e
+		}
+	}()
+
+	size := fi.Size()
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, seekData)
+		if err != nil {
+			if e, ok := err.(*os.PathError); !ok || e.Err != enxio {
+				return nil, err
+			}
+
+			data = size // No more data.
+		}
+		if data > size {
+			data = size
+		}
+		if data > off {
+			x = append(x, Extent{off, data - off, true})
+		}
+		if data == size {
+			break
+		}
+
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+
+		if hole > size {
+			hole = size
+		}
+		x = append(x, Extent{data, hole - data, false})
+		off = hole
+	}
+	return
+}
+
+// fillHoles returns the extents of a file of size having data extents data,
+// sorted by offset, with the gaps between them reported as holes. Adjacent
+// data extents are merged.
+func fillHoles(data []Extent, size int64) (x []Extent) {
+	off := int64(0)
+	for _, v := range data {
+		end := v.Off + v.Len
+		if end > size {
+			end = size
+		}
+		if end <= off {
+			continue
+		}
+
+		if v.Off > off {
+			x = append(x, Extent{off, v.Off - off, true})
+			off = v.Off
+		}
+		if n := len(x); n != 0 && !x[n-1].Hole {
+			x[n-1].Len = end - x[n-1].Off
+		} else {
+			x = append(x, Extent{off, end - off, false})
+		}
+		off = end
+	}
+	if off < size {
+		x = append(x, Extent{off, size - off, true})
+	}
+	return
+}
+
+// cloner clones the content of src to dst, if supported by the OS and the
+// file system.
+var cloner = func(dst, src *os.File) error { return ErrUnsupported }
+
+// ErrSameFile is returned by CopyFile if dst and src name the same file.
+var ErrSameFile = errors.New("source and destination are the same file")
+
+// CopyFile copies the file named src to the file named dst, creating or
+// truncating it. Holes of src are preserved, see Copy. If dst names the same
+// file as src, eg. via a hard or a symbolic link, CopyFile returns ErrSameFile
+// and both are left untouched.
+func CopyFile(dst, src string) (err error) {
+	s, err := os.Open(src)
+	if err != nil {
+		return
+	}
+
+	defer s.Close()
+
+	fi, err := s.Stat()
+	if err != nil {
+		return
+	}
+
+	if dfi, err := os.Stat(dst); err == nil && os.SameFile(fi, dfi) {
+		return ErrSameFile
+	}
+
+	d, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return
+	}
+
+	if _, err = Copy(d, s); err != nil {
+		d.Close()
+		os.Remove(dst)
+		return
+	}
+
+	return d.Close()
+}
+
+// Copy replaces the content of dst with the content of src and returns the
+// size of src. Where supported, the data are shared using a reflink clone.
+// Otherwise only the data extents of src are copied, using copy_file_range
+// where supported, and the holes of src are recreated in dst. The file offsets
+// of dst and src are not preserved.
+func Copy(dst, src *os.File) (n int64, err error) {
+	fi, err := src.Stat()
+	if err != nil {
+		return
+	}
+
+	size := fi.Size()
+	if cloner(dst, src) == nil {
+		return size, nil
+	}
+
+	x, err := Extents(src)
+	if err != nil {
+		return
+	}
+
+	if err = dst.Truncate(0); err != nil {
+		return
+	}
+
+	if err = dst.Truncate(size); err != nil {
+		return
+	}
+
+	for _, v := range x {
+		if v.Hole {
+			continue
+		}
+
+		if _, err = src.Seek(v.Off, io.SeekStart); err != nil {
+			return
+		}
+
+		if _, err = dst.Seek(v.Off, io.SeekStart); err != nil {
+			return
+		}
+
+		m, err := dst.ReadFrom(io.LimitReader(src, v.Len))
+		if err != nil {
+			return 0, err
+		}
+
+		if m != v.Len {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	return size, nil
+}
+
+// LockMode is used by Lock and LockRange.
+type LockMode int
+
+// LockMode values.
+const (
+	LockShared    LockMode = iota + 1 // Other shared locks are allowed.
+	LockExclusive                     // No other locks are allowed.
+)
+
+// ErrLocked is returned by TryLock and TryLockRange if a conflicting lock is
+// held.
+var ErrLocked = errors.New("file is locked")
+
+// rangeLock locks the byte range of f starting at off and continuing for len
+// bytes, or up to infinity if len is zero. If wait is false, a conflicting
+// lock is not waited for.
+var rangeLock = func(f *os.File, mode LockMode, off, len int64, wait bool) error { return ErrUnsupported }
+
+// rangeUnlock unlocks a byte range locked by rangeLock.
+var rangeUnlock = func(f *os.File, off, len int64) error { return ErrUnsupported }
+
+// Lock locks the whole file f in mode, waiting for conflicting locks to be
+// released. The lock is advisory, it protects f only against other locks,
+// except on Windows where it's mandatory. The lock is released by Unlock or by
+// closing f. Lock returns ErrUnsupported if locking is not supported.
+func Lock(f *os.File, mode LockMode) error {
+	return LockRange(f, mode, 0, 0)
+}
+
+// TryLock is like Lock, but it returns ErrLocked instead of waiting for a
+// conflicting lock to be released.
+func TryLock(f *os.File, mode LockMode) error {
+	return TryLockRange(f, mode, 0, 0)
+}
+
+// Unlock releases a lock of f acquired by Lock or TryLock.
+func Unlock(f *os.File) error {
+	return UnlockRange(f, 0, 0)
+}
+
+// LockRange is like Lock, but it locks only the byte range of f starting at
+// off and continuing for len bytes, or up to infinity if len is zero.
+//
+// On Linux, open file description locks are used. They are associated with
+// the opened file, thus they conflict also with the locks of other opened
+// instances of the same file in the same process. Before Linux 3.15 whole file
+// locks use flock, with the same semantics, but range locks are associated
+// with the process. So are all the locks on the other Unix OSes: they don't
+// conflict with locks of the same process and closing any file descriptor of
+// the file releases all of them.
+func LockRange(f *os.File, mode LockMode, off, len int64) error {
+	return lockRange(f, mode, off, len, true)
+}
+
+// TryLockRange is like LockRange, but it returns ErrLocked instead of waiting
+// for a conflicting lock to be released.
+func TryLockRange(f *os.File, mode LockMode, off, len int64) error {
+	return lockRange(f, mode, off, len, false)
+}
+
+// UnlockRange releases the lock of a byte range of f acquired by LockRange or
+// TryLockRange.
+func UnlockRange(f *os.File, off, len int64) error {
+	if off < 0 || len < 0 {
+		return os.NewSyscallError("unlock", syscall.EINVAL)
+	}
+
+	return rangeUnlock(f, off, len)
+}
+
+func lockRange(f *os.File, mode LockMode, off, len int64, wait bool) error {
+	if mode != LockShared && mode != LockExclusive || off < 0 || len < 0 {
+		return os.NewSyscallError("lock", syscall.EINVAL)
+	}
+
+	return rangeLock(f, mode, off, len, wait)
+}
+
 // TempFile creates a new temporary file in the directory dir with a name
 // ending with suffix, basename starting with prefix, opens the file for
 // reading and writing, and returns the resulting *os.File.  If dir is the
@@ -180,6 +996,12 @@ const (
 //
 // NOTE: This function differs from ioutil.TempFile.
 func TempFile(dir, prefix, suffix string) (f *os.File, err error) {
+	return tempFile(dir, prefix, suffix, 0600)
+}
+
+// tempFile is TempFile creating the file with permissions perm (before
+// umask).
+func tempFile(dir, prefix, suffix string, perm os.FileMode) (f *os.File, err error) {
 	if dir == "" {
 		dir = os.TempDir()
 	}
@@ -187,7 +1009,7 @@ func TempFile(dir, prefix, suffix string) (f *os.File, err error) {
 	nconflict := 0
 	for i := 0; i < 10000; i++ {
 		name := filepath.Join(dir, prefix+nextInfix()+suffix)
-		f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
 		if os.IsExist(err) {
 			if nconflict++; nconflict > 10 {
 				randmu.Lock()
@@ -201,6 +1023,119 @@ func TempFile(dir, prefix, suffix string) (f *os.File, err error) {
 	return
 }
 
+// anonTemp creates an unnamed temporary file in dir, if supported by the OS
+// and the file system.
+var anonTemp = func(dir string, perm os.FileMode) (*os.File, error) { return nil, ErrUnsupported }
+
+// linkTemp links the unnamed temporary file f to name.
+var linkTemp = func(f *os.File, name string) error { return ErrUnsupported }
+
+// AtomicWriter writes a file which replaces its target path atomically on
+// Commit. Readers of the path see either the old or the new content, never
+// a partially written file.
+type AtomicWriter struct {
+	*os.File
+	path string
+	tmp  string // Name of the temporary file, "" if it's unnamed.
+	done bool
+}
+
+// CreateAtomic returns an AtomicWriter of a temporary file created in the
+// directory of path with permissions perm (before umask), like os.OpenFile
+// creating a file does. Where supported, the temporary file is unnamed,
+// otherwise it's a named temporary file like those of TempFile.
+func CreateAtomic(path string, perm os.FileMode) (w *AtomicWriter, err error) {
+	dir := filepath.Dir(path)
+	w = &AtomicWriter{path: path}
+	if w.File, err = anonTemp(dir, perm); err == nil {
+		return
+	}
+
+	if w.File, err = tempFile(dir, "."+filepath.Base(path)+".", ".tmp", perm); err != nil {
+		return nil, err
+	}
+
+	w.tmp = w.Name()
+	return
+}
+
+// Commit syncs the temporary file, renames it to the target path and syncs
+// the directory. The temporary file is removed if Commit fails. The
+// AtomicWriter cannot be used after Commit.
+func (w *AtomicWriter) Commit() (err error) {
+	if w.done {
+		return ErrClosed
+	}
+
+	w.done = true
+	defer func() {
+		if err != nil {
+			w.Close()
+			if w.tmp != "" {
+				os.Remove(w.tmp)
+			}
+		}
+	}()
+
+	if err = w.Sync(); err != nil {
+		return
+	}
+
+	dir := filepath.Dir(w.path)
+	if w.tmp == "" {
+		w.tmp = filepath.Join(dir, "."+filepath.Base(w.path)+"."+nextInfix()+".tmp")
+		if err = linkTemp(w.File, w.tmp); err != nil {
+			w.tmp = ""
+			return
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	if err = os.Rename(w.tmp, w.path); err != nil {
+		return
+	}
+
+	return syncDir(dir)
+}
+
+// Abort closes and removes the temporary file. Abort after Commit is a no-op,
+// thus it can be deferred.
+func (w *AtomicWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	err := w.Close()
+	if w.tmp != "" {
+		if e := os.Remove(w.tmp); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// syncDir commits the directory entries of dir to stable storage.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" { // Directories cannot be synced.
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
 // Random number state.
 // We generate random temporary file names so that there's a good
 // chance the file doesn't exist yet - keeps the number of tries in
@@ -13,12 +13,44 @@ import (
 
 const hasPunchHole = false
 
+func init() {
+	rangeLock, rangeUnlock = fcntlLock, fcntlUnlock
+}
+
 // PunchHole deallocates space inside a file in the byte range starting at
 // offset and continuing for len bytes. Unimplemented on DragonFlyBSD.
 func PunchHole(f *os.File, off, len int64) error {
 	return nil
 }
 
+// CanPunchHole reports whether PunchHole is supported for f. Always false on
+// DragonFly BSD.
+func CanPunchHole(f *os.File) bool {
+	return false
+}
+
+// Fallocate manipulates the allocated space of a file in the byte range
+// starting at offset and continuing for len bytes according to mode. On DragonFlyBSD
+// only FALLOC_FL_DEFAULT and FALLOC_FL_ZERO_RANGE, optionally with
+// FALLOC_FL_KEEP_SIZE, are supported by writing zeros. FALLOC_FL_KEEP_SIZE
+// alone is a no op. Other modes return ErrUnsupported.
+func Fallocate(f *os.File, mode FallocateMode, off, len int64) error {
+	return fallocate(f, mode, off, len)
+}
+
+// Preallocate allocates space for a file in the byte range starting at offset
+// and continuing for len bytes. The file size doesn't change. Unimplemented on DragonFlyBSD.
+func Preallocate(f *os.File, off, len int64) error {
+	return nil
+}
+
+// Extents returns the data and hole extents of f, sorted by offset and
+// covering the whole file. Not supported on DragonFly BSD, the whole file is reported as
+// a single data extent.
+func Extents(f *os.File) ([]Extent, error) {
+	return extents(f)
+}
+
 // Fadvise predeclares an access pattern for file data.  See also 'man 2
 // posix_fadvise'. Unimplemented on DragonFlyBSD.
 func Fadvise(f *os.File, off, len int64, advice FadviseAdvice) error {
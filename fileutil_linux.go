@@ -8,77 +8,397 @@ package fileutil
 
 import (
 	"bytes"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"strconv"
+	"path/filepath"
+	"sync"
 	"syscall"
+	"unsafe"
 )
 
 const hasPunchHole = true
 
-func n(s []byte) byte {
-	for i, c := range s {
-		if c < '0' || c > '9' {
-			s = s[:i]
+func init() {
+	cloner = ficlone
+	watcher = watchInotify
+	rangeLock, rangeUnlock = ofdLock, ofdUnlock
+	datasync, writeBehind = fdatasync, syncFileRange
+	if unsafe.Sizeof(uintptr(0)) == 8 { // 64 bit offsets are passed in one register.
+		readahead = readahead64
+	}
+	if _, err := os.Stat("/proc/self/fd"); err == nil {
+		anonTemp, linkTemp = openTmpfile, linkTmpfile
+	}
+}
+
+var (
+	punchMu   sync.Mutex
+	punchDevs = map[uint64]bool{} // Device: hole punching supported.
+)
+
+// punchDev returns the device of the file system f resides on.
+func punchDev(f *os.File) (uint64, bool) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, false
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return uint64(st.Dev), true
+}
+
+// setPunch records whether the file system f resides on supports hole
+// punching.
+func setPunch(f *os.File, ok bool) {
+	if dev, known := punchDev(f); known {
+		punchMu.Lock()
+		punchDevs[dev] = ok
+		punchMu.Unlock()
+	}
+}
+
+// PunchHole deallocates space inside a file in the byte range starting at
+// offset and continuing for len bytes. PunchHole returns ErrUnsupported if the
+// kernel or the file system doesn't support it, see also CanPunchHole.
+func PunchHole(f *os.File, off, len int64) error {
+	err := Fallocate(f, FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE, off, len)
+	switch err {
+	case nil:
+		setPunch(f, true)
+	case ErrUnsupported:
+		setPunch(f, false)
+	}
+	return err
+}
+
+// CanPunchHole reports whether PunchHole is supported for f. The result is
+// determined by punching a hole past the end of f, which must be writable, and
+// it's cached per file system.
+func CanPunchHole(f *os.File) bool {
+	dev, ok := punchDev(f)
+	if !ok {
+		return false
+	}
+
+	punchMu.Lock()
+	can, ok := punchDevs[dev]
+	punchMu.Unlock()
+	if ok {
+		return can
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	// An error other than ErrUnsupported, eg. f not open for writing, is not
+	// cached.
+	return PunchHole(f, fi.Size()+1<<16, 1<<12) == nil
+}
+
+// Fallocate manipulates the allocated space of a file in the byte range
+// starting at offset and continuing for len bytes according to mode. See also
+// 'man 2 fallocate'. Fallocate returns ErrUnsupported if the kernel or the
+// file system doesn't support mode.
+func Fallocate(f *os.File, mode FallocateMode, off, len int64) error {
+	// syscall.Fallocate passes off and len properly on 32 bit platforms.
+	switch err := syscall.Fallocate(int(f.Fd()), uint32(mode), off, len); err {
+	case nil:
+		return nil
+	case syscall.EOPNOTSUPP, syscall.ENOSYS:
+		return ErrUnsupported
+	default:
+		return os.NewSyscallError("SYS_FALLOCATE", err)
+	}
+}
+
+// Preallocate allocates space for a file in the byte range starting at offset
+// and continuing for len bytes. The file size doesn't change.
+func Preallocate(f *os.File, off, len int64) error {
+	return Fallocate(f, FALLOC_FL_KEEP_SIZE, off, len)
+}
+
+// Extents returns the data and hole extents of f, sorted by offset and
+// covering the whole file. It uses lseek SEEK_DATA/SEEK_HOLE and falls back to
+// the FIEMAP ioctl on kernels or file systems not supporting them. If neither
+// is supported, the whole file is reported as a single data extent.
+func Extents(f *os.File) ([]Extent, error) {
+	x, err := seekExtents(f, 3, 4, syscall.ENXIO)
+	if e, ok := err.(*os.PathError); !ok || e.Err != syscall.EINVAL {
+		return x, err
+	}
+
+	if x, err = fiemapExtents(f); err == ErrUnsupported {
+		return extents(f)
+	}
+
+	return x, err
+}
+
+// $ grep FIEMAP /usr/include/linux/fiemap.h /usr/include/linux/fs.h
+const (
+	fsIocFiemap       = 0xc020660b
+	fiemapFlagSync    = 0x0001
+	fiemapExtentLast  = 0x0001
+	fiemapExtentCount = 32
+)
+
+type fiemapExtent struct {
+	logical, physical, length uint64
+	_                         [2]uint64
+	flags                     uint32
+	_                         [3]uint32
+}
+
+type fiemap struct {
+	start, length                  uint64
+	flags, mapped, count, reserved uint32
+	extents                        [fiemapExtentCount]fiemapExtent
+}
+
+// fiemapExtents enumerates the extents of f using the FIEMAP ioctl.
+func fiemapExtents(f *os.File) ([]Extent, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := fi.Size()
+	var data []Extent
+	m := &fiemap{}
+	for start := uint64(0); start < uint64(size); {
+		*m = fiemap{start: start, length: uint64(size) - start, flags: fiemapFlagSync, count: fiemapExtentCount}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(m)))
+		switch errno {
+		case 0:
+		case syscall.EOPNOTSUPP, syscall.ENOTTY:
+			return nil, ErrUnsupported
+		default:
+			return nil, os.NewSyscallError("FS_IOC_FIEMAP", errno)
+		}
+
+		if m.mapped == 0 {
 			break
 		}
+
+		for _, v := range m.extents[:m.mapped] {
+			data = append(data, Extent{int64(v.logical), int64(v.length), false})
+		}
+		last := m.extents[m.mapped-1]
+		if last.flags&fiemapExtentLast != 0 {
+			break
+		}
+
+		start = last.logical + last.length
 	}
-	v, _ := strconv.Atoi(string(s))
-	return byte(v)
+	return fillHoles(data, size), nil
 }
 
-func init() {
-	b, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+// $ grep FICLONE /usr/include/linux/fs.h
+const ficloneIoc = 0x40049409
+
+// ficlone shares the data of src with dst using the FICLONE ioctl.
+func ficlone(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficloneIoc, src.Fd())
+	if errno != 0 {
+		return os.NewSyscallError("FICLONE", errno)
+	}
+
+	return nil
+}
+
+// inotify watches an MFile and its directory using inotify(7).
+type inotify struct {
+	m    *MFile
+	f    *os.File // The inotify instance.
+	fd   int      // Of f, f.Fd would make it blocking.
+	dir  int      // Watch descriptor of the directory.
+	file int      // Watch descriptor of the file.
+	base string
+}
+
+const (
+	inotifyFile = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE
+	inotifyDir  = syscall.IN_CREATE | syscall.IN_MOVED_TO
+)
+
+// watchInotify starts watching m. The file is reopened by path when it's
+// replaced in its directory.
+func watchInotify(m *MFile) (io.Closer, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
 	if err != nil {
-		panic(err)
+		return nil, os.NewSyscallError("inotify_init1", err)
 	}
 
-	tokens := bytes.Split(b, []byte("."))
-	if len(tokens) > 3 {
-		tokens = tokens[:3]
+	// fd is non blocking, Close unblocks a pending Read.
+	w := &inotify{m: m, f: os.NewFile(uintptr(fd), "inotify"), fd: fd, base: filepath.Base(m.name)}
+	if w.dir, err = syscall.InotifyAddWatch(fd, filepath.Dir(m.name), inotifyDir); err != nil {
+		w.f.Close()
+		return nil, os.NewSyscallError("inotify_add_watch", err)
 	}
-	switch len(tokens) {
-	case 3:
-		// Supported since kernel 2.6.38
-		if bytes.Compare([]byte{n(tokens[0]), n(tokens[1]), n(tokens[2])}, []byte{2, 6, 38}) < 0 {
-			puncher = func(*os.File, int64, int64) error { return nil }
+
+	if w.file, err = syscall.InotifyAddWatch(fd, m.name, inotifyFile); err != nil {
+		w.f.Close()
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Close implements io.Closer.
+func (w *inotify) Close() error {
+	return w.f.Close()
+}
+
+// run processes the inotify events until w is closed.
+func (w *inotify) run() {
+	buf := make([]byte, 1<<12)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
 		}
-	case 2:
-		if bytes.Compare([]byte{n(tokens[0]), n(tokens[1])}, []byte{2, 7}) < 0 {
-			puncher = func(*os.File, int64, int64) error { return nil }
+
+		var changed, replaced bool
+		for b := buf[:n]; len(b) >= syscall.SizeofInotifyEvent; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&b[0]))
+			name := b[syscall.SizeofInotifyEvent : syscall.SizeofInotifyEvent+int(ev.Len)]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			switch int(ev.Wd) {
+			case w.dir:
+				if ev.Mask&inotifyDir != 0 && string(name) == w.base {
+					replaced = true
+				}
+			case w.file:
+				if ev.Mask&inotifyFile != 0 {
+					changed = true
+				}
+			}
+			b = b[syscall.SizeofInotifyEvent+int(ev.Len):]
+		}
+		if replaced {
+			if wd, err := syscall.InotifyAddWatch(w.fd, w.m.name, inotifyFile); err == nil {
+				w.file = wd
+			}
+		}
+		if changed || replaced {
+			w.m.changed(w, replaced)
 		}
-	default:
-		puncher = func(*os.File, int64, int64) error { return nil }
 	}
 }
 
-var puncher = func(f *os.File, off, len int64) error {
-	const (
-		/*
-			/usr/include/linux$ grep FL_ falloc.h
-		*/
-		_FALLOC_FL_KEEP_SIZE  = 0x01 // default is extend size
-		_FALLOC_FL_PUNCH_HOLE = 0x02 // de-allocates range
-	)
+// $ grep -r __O_TMPFILE /usr/include/asm-generic/fcntl.h
+const oTmpfile = 0x400000 | syscall.O_DIRECTORY
 
-	_, _, errno := syscall.Syscall6(
-		syscall.SYS_FALLOCATE,
-		uintptr(f.Fd()),
-		uintptr(_FALLOC_FL_KEEP_SIZE|_FALLOC_FL_PUNCH_HOLE),
-		uintptr(off),
-		uintptr(len),
-		0, 0)
-	if errno != 0 {
-		return os.NewSyscallError("SYS_FALLOCATE", errno)
+// openTmpfile creates an unnamed temporary file in dir using O_TMPFILE.
+func openTmpfile(dir string, perm os.FileMode) (*os.File, error) {
+	fd, err := syscall.Open(dir, oTmpfile|syscall.O_RDWR|syscall.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
 	}
+
+	return os.NewFile(uintptr(fd), filepath.Join(dir, "(unnamed)")), nil
+}
+
+// linkTmpfile links the O_TMPFILE file f to name.
+func linkTmpfile(f *os.File, name string) error {
+	const atSymlinkFollow = 0x400
+	atFdcwd := -100 // AT_FDCWD, a variable as it's negative.
+	old, err := syscall.BytePtrFromString(fmt.Sprintf("/proc/self/fd/%d", f.Fd()))
+	if err != nil {
+		return err
+	}
+
+	new, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	if _, _, errno := syscall.Syscall6(
+		syscall.SYS_LINKAT,
+		uintptr(atFdcwd),
+		uintptr(unsafe.Pointer(old)),
+		uintptr(atFdcwd),
+		uintptr(unsafe.Pointer(new)),
+		atSymlinkFollow, 0); errno != 0 {
+		return &os.LinkError{Op: "linkat", Old: f.Name(), New: name, Err: errno}
+	}
+
 	return nil
 }
 
-// PunchHole deallocates space inside a file in the byte range starting at
-// offset and continuing for len bytes. No-op for kernels < 2.6.38 (or < 2.7).
-func PunchHole(f *os.File, off, len int64) error {
-	return puncher(f, off, len)
+// $ grep F_OFD /usr/include/asm-generic/fcntl.h
+const (
+	fOfdSetlk  = 37
+	fOfdSetlkw = 38
+)
+
+// ofdUnsupported reports whether err means open file description locks are not
+// supported by the kernel, ie. before Linux 3.15.
+func ofdUnsupported(err error) bool {
+	e, ok := err.(*os.SyscallError)
+	return ok && e.Err == syscall.EINVAL
+}
+
+// ofdLock is the rangeLock of Linux. Where open file description locks are not
+// supported, whole file locks fall back to flock and range locks to process
+// associated fcntl locks.
+func ofdLock(f *os.File, mode LockMode, off, len int64, wait bool) error {
+	cmd := fOfdSetlk
+	if wait {
+		cmd = fOfdSetlkw
+	}
+	err := fcntl(f, cmd, lockType(mode), off, len)
+	if !ofdUnsupported(err) {
+		return err
+	}
+
+	if off != 0 || len != 0 {
+		return fcntlLock(f, mode, off, len, wait)
+	}
+
+	how := syscall.LOCK_EX
+	if mode == LockShared {
+		how = syscall.LOCK_SH
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	return flock(f, how)
+}
+
+// ofdUnlock is the rangeUnlock matching ofdLock.
+func ofdUnlock(f *os.File, off, len int64) error {
+	err := fcntl(f, fOfdSetlk, syscall.F_UNLCK, off, len)
+	if !ofdUnsupported(err) {
+		return err
+	}
+
+	if off != 0 || len != 0 {
+		return fcntlUnlock(f, off, len)
+	}
+
+	return flock(f, syscall.LOCK_UN)
+}
+
+func flock(f *os.File, how int) error {
+	switch err := syscall.Flock(int(f.Fd()), how); err {
+	case nil:
+		return nil
+	case syscall.EWOULDBLOCK:
+		return ErrLocked
+	default:
+		return os.NewSyscallError("flock", err)
+	}
 }
 
 // Fadvise predeclares an access pattern for file data.  See also 'man 2
@@ -91,7 +411,36 @@ func Fadvise(f *os.File, off, len int64, advice FadviseAdvice) error {
 		uintptr(len),
 		uintptr(advice),
 		0, 0)
-	return os.NewSyscallError("SYS_FADVISE64", errno)
+	if errno != 0 {
+		return os.NewSyscallError("SYS_FADVISE64", errno)
+	}
+
+	return nil
+}
+
+func readahead64(f *os.File, off, len int64) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_READAHEAD, f.Fd(), uintptr(off), uintptr(len)); errno != 0 {
+		return os.NewSyscallError("SYS_READAHEAD", errno)
+	}
+
+	return nil
+}
+
+func fdatasync(f *os.File) error {
+	if err := syscall.Fdatasync(int(f.Fd())); err != nil {
+		return os.NewSyscallError("fdatasync", err)
+	}
+
+	return nil
+}
+
+func syncFileRange(f *os.File, off, len int64) error {
+	const syncFileRangeWrite = 2
+	if err := syscall.SyncFileRange(int(f.Fd()), off, len, syncFileRangeWrite); err != nil {
+		return os.NewSyscallError("sync_file_range", err)
+	}
+
+	return nil
 }
 
 // IsEOF reports whether err is an EOF condition.
@@ -9,16 +9,55 @@ package fileutil
 import (
 	"io"
 	"os"
+	"syscall"
 )
 
 const hasPunchHole = false
 
+func init() {
+	rangeLock, rangeUnlock = fcntlLock, fcntlUnlock
+}
+
 // PunchHole deallocates space inside a file in the byte range starting at
 // offset and continuing for len bytes. Not supported on Solaris.
 func PunchHole(f *os.File, off, len int64) error {
 	return nil
 }
 
+// CanPunchHole reports whether PunchHole is supported for f. Always false on
+// Solaris.
+func CanPunchHole(f *os.File) bool {
+	return false
+}
+
+// Fallocate manipulates the allocated space of a file in the byte range
+// starting at offset and continuing for len bytes according to mode. On Solaris
+// only FALLOC_FL_DEFAULT and FALLOC_FL_ZERO_RANGE, optionally with
+// FALLOC_FL_KEEP_SIZE, are supported by writing zeros. FALLOC_FL_KEEP_SIZE
+// alone is a no op. Other modes return ErrUnsupported.
+func Fallocate(f *os.File, mode FallocateMode, off, len int64) error {
+	return fallocate(f, mode, off, len)
+}
+
+// Preallocate allocates space for a file in the byte range starting at offset
+// and continuing for len bytes. The file size doesn't change. Not supported on Solaris.
+func Preallocate(f *os.File, off, len int64) error {
+	return nil
+}
+
+// Extents returns the data and hole extents of f, sorted by offset and
+// covering the whole file. It uses lseek SEEK_DATA/SEEK_HOLE. If the file
+// system doesn't support them, the whole file is reported as a single data
+// extent.
+func Extents(f *os.File) ([]Extent, error) {
+	x, err := seekExtents(f, 3, 4, syscall.ENXIO)
+	if e, ok := err.(*os.PathError); ok && (e.Err == syscall.EINVAL || e.Err == syscall.ENOTSUP) {
+		return extents(f)
+	}
+
+	return x, err
+}
+
 // Fadvise predeclares an access pattern for file data.  See also 'man 2
 // posix_fadvise'. Not supported on Solaris.
 func Fadvise(f *os.File, off, len int64, advice FadviseAdvice) error {
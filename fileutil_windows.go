@@ -15,11 +15,39 @@ import (
 const hasPunchHole = true
 
 // PunchHole deallocates space inside a file in the byte range starting at
-// offset and continuing for len bytes. Not supported on Windows.
+// offset and continuing for len bytes.
 func PunchHole(f *os.File, off, len int64) error {
 	return puncher(f, off, len)
 }
 
+// CanPunchHole reports whether PunchHole is supported for f. The file is
+// marked sparse if it's not yet.
+func CanPunchHole(f *os.File) bool {
+	return ensureFileSparse(f) == nil
+}
+
+// Fallocate manipulates the allocated space of a file in the byte range
+// starting at offset and continuing for len bytes according to mode. On Windows
+// only FALLOC_FL_DEFAULT and FALLOC_FL_ZERO_RANGE, optionally with
+// FALLOC_FL_KEEP_SIZE, are supported by writing zeros. FALLOC_FL_KEEP_SIZE
+// alone is a no op. Other modes return ErrUnsupported.
+func Fallocate(f *os.File, mode FallocateMode, off, len int64) error {
+	return fallocate(f, mode, off, len)
+}
+
+// Preallocate allocates space for a file in the byte range starting at offset
+// and continuing for len bytes. The file size doesn't change. Not supported on Windows.
+func Preallocate(f *os.File, off, len int64) error {
+	return nil
+}
+
+// Extents returns the data and hole extents of f, sorted by offset and
+// covering the whole file. Not supported on Windows, the whole file is reported as
+// a single data extent.
+func Extents(f *os.File) ([]Extent, error) {
+	return extents(f)
+}
+
 // Fadvise predeclares an access pattern for file data.  See also 'man 2
 // posix_fadvise'. Not supported on Windows.
 func Fadvise(f *os.File, off, len int64, advice FadviseAdvice) error {
@@ -51,6 +79,55 @@ func init() {
 	// msdn.microsoft.com/en-us/library/windows/desktop/aa364225(v=vs.85).aspx
 	// the file handles are unique per process.
 	sparseFiles = make(map[uintptr]struct{})
+	rangeLock, rangeUnlock = lockFileEx, unlockFileEx
+}
+
+var (
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+// lockFileEx is the rangeLock of Windows. Locks of Windows are mandatory.
+func lockFileEx(f *os.File, mode LockMode, off, len int64, wait bool) error {
+	const (
+		lockfileFailImmediately = 0x1
+		lockfileExclusiveLock   = 0x2
+		errorLockViolation      = 33
+	)
+
+	var flags uintptr
+	if mode == LockExclusive {
+		flags |= lockfileExclusiveLock
+	}
+	if !wait {
+		flags |= lockfileFailImmediately
+	}
+	if len == 0 {
+		len = -1
+	}
+	ol := syscall.Overlapped{Offset: uint32(off), OffsetHigh: uint32(off >> 32)}
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, uintptr(uint32(len)), uintptr(uint32(len>>32)), uintptr(unsafe.Pointer(&ol)))
+	switch {
+	case r != 0:
+		return nil
+	case err == syscall.Errno(errorLockViolation):
+		return ErrLocked
+	default:
+		return os.NewSyscallError("LockFileEx", err)
+	}
+}
+
+// unlockFileEx is the rangeUnlock of Windows.
+func unlockFileEx(f *os.File, off, len int64) error {
+	if len == 0 {
+		len = -1
+	}
+	ol := syscall.Overlapped{Offset: uint32(off), OffsetHigh: uint32(off >> 32)}
+	if r, _, err := procUnlockFileEx.Call(f.Fd(), 0, uintptr(uint32(len)), uintptr(uint32(len>>32)), uintptr(unsafe.Pointer(&ol))); r == 0 {
+		return os.NewSyscallError("UnlockFileEx", err)
+	}
+
+	return nil
 }
 
 // puncHoleWindows punches a hole into the given file starting at offset,
@@ -7,9 +7,120 @@
 package hdb
 
 import (
+	"bytes"
 	"testing"
+
+	"github.com/cznic/fileutil/falloc"
+	"github.com/cznic/fileutil/storage"
 )
 
 func TestPlaceholder(t *testing.T) {
 	t.Log("TODO") //TODO
 }
+
+func TestOpenReadOnly(t *testing.T) {
+	sim := storage.NewCrashSim("test.db", nil, nil)
+	s, err := New(sim)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	data := []byte("data")
+	h, err := s.New(data)
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	if s, err = OpenReadOnly(sim, nil); err != nil {
+		t.Fatal(30, err)
+	}
+
+	n := sim.Ops()
+	if b, err := s.Get(h); err != nil || !bytes.Equal(b, data) {
+		t.Fatal(40, b, err)
+	}
+
+	if err = s.Set(h, nil); err != falloc.EReadOnly("test.db") {
+		t.Fatal(50, err)
+	}
+
+	if err = s.Delete(h); err != falloc.EReadOnly("test.db") {
+		t.Fatal(60, err)
+	}
+
+	if sim.Ops() != n {
+		t.Fatal(70, sim.Ops(), n)
+	}
+}
+
+// Check that a Store kept in a WAL keeps its data intact after a crash at any
+// write.
+func TestCrash(t *testing.T) {
+	sim := storage.NewCrashSim("test.db", nil, nil)
+	s, err := New(sim)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	data := []byte("persistent")
+	h, err := s.New(data)
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	store := storage.NewCrashSim("test.db", sim.Image(sim.Ops(), 0), nil)
+	log := storage.NewCrashSim("test.log", nil, store)
+	w, err := storage.NewWAL(store, log)
+	if err != nil {
+		t.Fatal(30, err)
+	}
+
+	if s, err = Open(w); err != nil {
+		t.Fatal(40, err)
+	}
+
+	var hs []falloc.Handle
+	for i := 0; i < 4; i++ {
+		h, err := s.New(bytes.Repeat([]byte{byte(i)}, 300*i))
+		if err != nil {
+			t.Fatal(50, err)
+		}
+
+		hs = append(hs, h)
+	}
+	if err := s.Set(s.Root(), []byte("root")); err != nil {
+		t.Fatal(60, err)
+	}
+
+	if err := s.Delete(hs[1]); err != nil {
+		t.Fatal(70, err)
+	}
+
+	for i := 0; i <= store.Ops(); i++ {
+		n := store.Sectors(i) + log.Sectors(i)
+		for sectors := 0; sectors <= n; sectors++ {
+			w, err := storage.NewWAL(store.Crash(i, sectors), log.Crash(i, sectors))
+			if err != nil {
+				t.Fatal(80, i, sectors, err)
+			}
+
+			s, err := Open(w)
+			if err != nil {
+				t.Fatal(90, i, sectors, err)
+			}
+
+			b, err := s.Get(h)
+			if err != nil {
+				t.Fatal(100, i, sectors, err)
+			}
+
+			if !bytes.Equal(b, data) {
+				t.Fatal(110, i, sectors, b, data)
+			}
+
+			if b, err = s.Get(s.Root()); err != nil || len(b) != 0 && string(b) != "root" {
+				t.Fatal(120, i, sectors, b, err)
+			}
+		}
+	}
+}
@@ -29,6 +29,8 @@ Conceptual analogy:
 package hdb
 
 import (
+	"io"
+
 	"github.com/cznic/fileutil/falloc"
 	"github.com/cznic/fileutil/storage"
 )
@@ -41,8 +43,14 @@ type Store struct {
 // If successful, methods on the returned Store can be used for I/O.
 // It returns the Store and an error, if any.
 func New(accessor storage.Accessor) (store *Store, err error) {
+	return NewWithOptions(accessor, nil)
+}
+
+// NewWithOptions is like New, but the options of the underlying falloc.File
+// are opts, nil means the defaults.
+func NewWithOptions(accessor storage.Accessor, opts *falloc.Options) (store *Store, err error) {
 	s := &Store{}
-	if s.f, err = falloc.New(accessor); err == nil {
+	if s.f, err = falloc.NewWithOptions(accessor, opts); err == nil {
 		store = s
 	}
 	return
@@ -52,8 +60,25 @@ func New(accessor storage.Accessor) (store *Store, err error) {
 // If successful, methods on the returned Store can be used for data exchange.
 // It returns the Store and an error, if any.
 func Open(accessor storage.Accessor) (store *Store, err error) {
+	return OpenWithOptions(accessor, nil)
+}
+
+// OpenWithOptions is like Open, but the options of the underlying falloc.File
+// are opts, nil means the defaults.
+func OpenWithOptions(accessor storage.Accessor, opts *falloc.Options) (store *Store, err error) {
 	s := &Store{}
-	if s.f, err = falloc.Open(accessor); err == nil {
+	if s.f, err = falloc.OpenWithOptions(accessor, opts); err == nil {
+		store = s
+	}
+	return
+}
+
+// OpenReadOnly opens the Store from accessor like OpenWithOptions, but the
+// Store cannot be modified, see falloc.OpenReadOnly. Its methods modifying it
+// return falloc.EReadOnly.
+func OpenReadOnly(accessor storage.Accessor, opts *falloc.Options) (store *Store, err error) {
+	s := &Store{}
+	if s.f, err = falloc.OpenReadOnly(accessor, opts); err == nil {
 		store = s
 	}
 	return
@@ -94,6 +119,21 @@ func (s *Store) Set(handle falloc.Handle, b []byte) (err error) {
 	return
 }
 
+// OpenReader returns a reader of the data associated with handle. The data
+// are read from the store on demand, the reader is valid only until the next
+// modification of 's'.
+// It returns the reader and an error, if any.
+func (s *Store) OpenReader(handle falloc.Handle) (r io.ReadSeeker, err error) {
+	return s.f.OpenReader(handle)
+}
+
+// NewWriter returns a writer associating the data written to it with a new
+// handle, available from the writer's Handle method after its Close method
+// succeeds.
+func (s *Store) NewWriter() *falloc.Writer {
+	return s.f.NewWriter()
+}
+
 // Root returns the handle of the DB root (top level directory, ...).
 func (s *Store) Root() falloc.Handle {
 	return s.f.Root()
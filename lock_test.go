@@ -0,0 +1,112 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH == "arm" {
+		// Elsewhere the locks of one process don't conflict.
+		t.Skip("needs open file description locks")
+	}
+
+	f1, err := ioutil.TempFile("", "lock-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f1.Name())
+	defer f1.Close()
+
+	f2, err := os.OpenFile(f1.Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	defer f2.Close()
+
+	if err = TryLock(f1, 0); err == nil {
+		t.Fatal(20)
+	}
+
+	if err = TryLock(f1, LockExclusive); err != nil {
+		t.Fatal(30, err)
+	}
+
+	if err = TryLock(f2, LockShared); err != ErrLocked {
+		t.Fatal(40, err)
+	}
+
+	if err = Unlock(f1); err != nil {
+		t.Fatal(50, err)
+	}
+
+	for _, f := range []*os.File{f1, f2} {
+		if err = TryLock(f, LockShared); err != nil {
+			t.Fatal(60, err)
+		}
+	}
+
+	if err = TryLock(f1, LockExclusive); err != ErrLocked {
+		t.Fatal(70, err)
+	}
+
+	// Lock waits for the conflicting lock to be released.
+	c := make(chan error)
+	go func() { c <- Lock(f1, LockExclusive) }()
+	select {
+	case err = <-c:
+		t.Fatal(80, err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err = Unlock(f2); err != nil {
+		t.Fatal(90, err)
+	}
+
+	if err = <-c; err != nil {
+		t.Fatal(100, err)
+	}
+
+	if err = Unlock(f1); err != nil {
+		t.Fatal(110, err)
+	}
+
+	// Ranges.
+	if err = TryLockRange(f1, LockExclusive, 0, 10); err != nil {
+		t.Fatal(120, err)
+	}
+
+	if err = TryLockRange(f2, LockExclusive, 10, 10); err != nil {
+		t.Fatal(130, err)
+	}
+
+	if err = TryLockRange(f2, LockShared, 5, 10); err != ErrLocked {
+		t.Fatal(140, err)
+	}
+
+	if err = UnlockRange(f1, 0, 10); err != nil {
+		t.Fatal(150, err)
+	}
+
+	if err = TryLockRange(f2, LockShared, 5, 10); err != nil {
+		t.Fatal(160, err)
+	}
+
+	// Closing releases the locks.
+	if err = f2.Close(); err != nil {
+		t.Fatal(170, err)
+	}
+
+	if err = TryLock(f1, LockExclusive); err != nil {
+		t.Fatal(180, err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+// +build !arm
+
+package fileutil
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// fcntl sets or clears a record lock using cmd. See also 'man 2 fcntl'.
+func fcntl(f *os.File, cmd int, typ int16, off, len int64) error {
+	lk := syscall.Flock_t{Type: typ, Whence: io.SeekStart, Start: off, Len: len}
+	switch err := syscall.FcntlFlock(f.Fd(), cmd, &lk); err {
+	case nil:
+		return nil
+	case syscall.EAGAIN, syscall.EACCES:
+		return ErrLocked
+	default:
+		return os.NewSyscallError("fcntl", err)
+	}
+}
+
+func lockType(mode LockMode) int16 {
+	if mode == LockShared {
+		return syscall.F_RDLCK
+	}
+
+	return syscall.F_WRLCK
+}
+
+// fcntlLock is the rangeLock of the Unix OSes not supporting open file
+// description locks. The locks are associated with the process.
+func fcntlLock(f *os.File, mode LockMode, off, len int64, wait bool) error {
+	cmd := syscall.F_SETLK
+	if wait {
+		cmd = syscall.F_SETLKW
+	}
+	return fcntl(f, cmd, lockType(mode), off, len)
+}
+
+// fcntlUnlock is the rangeUnlock matching fcntlLock.
+func fcntlUnlock(f *os.File, off, len int64) error {
+	return fcntl(f, syscall.F_SETLK, syscall.F_UNLCK, off, len)
+}
@@ -30,8 +30,14 @@ func TestPunch(t *testing.T) {
 	if err = file.Sync(); err != nil {
 		t.Logf("error syncing %q: %v", file.Name(), err)
 	}
+	can := CanPunchHole(file)
+	if fi, err := file.Stat(); err != nil || fi.Size() != int64(len(buf)) {
+		t.Fatalf("CanPunchHole changed the file: %v %v", fi, err)
+	}
 	for i, j := range []int{1, 31, 1 << 10} {
-		if err = PunchHole(file, int64(j), int64(j)); err != nil {
+		if err = PunchHole(file, int64(j), int64(j)); err == ErrUnsupported && !can {
+			continue
+		} else if err != nil {
 			t.Errorf("%d. error punching at %d, size %d: %v", i, j, j, err)
 			continue
 		}
@@ -48,7 +54,7 @@ func TestPunch(t *testing.T) {
 		if buf[n-1] == 0 {
 			t.Errorf("%d. file at %d has been overwritten with 0!", i, j-1+n)
 		}
-		if !hasPunchHole {
+		if !hasPunchHole || !can {
 			continue
 		}
 
@@ -0,0 +1,226 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"os"
+	"sync"
+
+	"github.com/cznic/fileutil"
+)
+
+// AdviseMode selects the behavior of an Advisor.
+type AdviseMode int
+
+// AdviseMode values, may be or-ed together.
+const (
+	// Start writing back the pages written back by the Cache and then
+	// advise the OS to drop them from the page cache, so that bulk
+	// updates don't evict everything else from it.
+	AdviseDontNeed AdviseMode = 1 << iota
+	// Advise the OS to read ahead when the Cache loads pages
+	// sequentially, eg. in a scan of the store.
+	AdviseReadahead
+)
+
+const (
+	adviseBatch     = 1 << 18 // Written bytes per write back and drop.
+	adviseSeqMin    = 4       // Sequential loads before reading ahead.
+	adviseAheadMin  = 1 << 16
+	adviseAheadMax  = 1 << 20
+	adviseAheadMult = 2
+)
+
+// Replaced in tests.
+var (
+	fadvise     = fileutil.Fadvise
+	writeBehind = fileutil.WriteBehind
+)
+
+// osFile returns the os.File backing a, if any. An Accessor which is not one
+// of the types of this package, but has a file descriptor, ie. an Fd() uintptr
+// method, is backed by a duplicate of the descriptor, which is then owned by
+// the caller.
+func osFile(a Accessor) (f *os.File, owned bool) {
+	switch x := a.(type) {
+	case *FileAccessor:
+		return x.File, false
+	case *Probe:
+		return osFile(x.Accessor)
+	case *Cache:
+		return osFile(x.f)
+	case *WAL:
+		return osFile(x.f)
+	case interface {
+		Fd() uintptr
+	}:
+		f = dupFile(x.Fd(), a.Name())
+		return f, f != nil
+	}
+	return nil, false
+}
+
+// CacheAdvisor is notified of the page loads and write backs of a Cache, see
+// SetAdvisor. Its methods are invoked without holding the lock of the Cache,
+// they may be invoked concurrently.
+type CacheAdvisor interface {
+	// Advise is invoked with the offset and size of every page loaded from
+	// the underlying store, write == false, and of every page written back
+	// to it, write == true.
+	Advise(off int64, n int, write bool)
+	// Flush is invoked at the end of every pass writing back dirty pages
+	// and by Close of the Cache.
+	Flush()
+}
+
+// adviseOp is a pending Fadvise or, if behind is true, WriteBehind call.
+type adviseOp struct {
+	off, n int64
+	advice fileutil.FadviseAdvice
+	behind bool
+}
+
+// Advisor is a CacheAdvisor which translates the page loads and write backs of
+// a Cache into fileutil.Fadvise calls on the os.File backing the store.
+type Advisor struct {
+	f     *os.File
+	mode  AdviseMode
+	mu    sync.Mutex
+	owned bool // f is a duplicate to be closed by Close
+
+	wr0, wr1 int64 // Written range not yet written back.
+	dn0, dn1 int64 // Written back range not yet dropped.
+
+	next  int64 // Offset of the next sequential load.
+	seq   int   // Number of sequential loads.
+	ahead int64 // Offset up to which reading ahead was advised.
+	n     int64 // Size of the next read ahead.
+}
+
+// NewAdvisor returns a new Advisor of store, to be passed to SetAdvisor of a
+// Cache. Store may be wrapped in a Probe, Cache or WAL, or it may be any
+// Accessor having an Fd() uintptr method. If mode is zero or if store is not
+// backed by a file, the Advisor does nothing. Errors of the advice are
+// ignored.
+//
+// The Advisor must be closed by Close after the Cache using it is closed.
+func NewAdvisor(store Accessor, mode AdviseMode) *Advisor {
+	f, owned := osFile(store)
+	if f != nil && mode == 0 {
+		if owned {
+			f.Close()
+		}
+		f, owned = nil, false
+	}
+	return &Advisor{f: f, mode: mode, owned: owned}
+}
+
+// Advise implements CacheAdvisor. The advice is collected under a.mu and it's
+// issued after unlocking.
+func (a *Advisor) Advise(off int64, n int, write bool) {
+	var ops []adviseOp
+	a.mu.Lock()
+	f := a.f
+	switch {
+	case f == nil:
+	case write && a.mode&AdviseDontNeed != 0:
+		ops = a.written(ops, off, int64(n))
+	case !write && a.mode&AdviseReadahead != 0:
+		ops = a.loaded(ops, off, int64(n))
+	}
+	a.mu.Unlock()
+	issue(f, ops)
+}
+
+// Flush implements CacheAdvisor. It starts writing back the pending written
+// range.
+func (a *Advisor) Flush() {
+	var ops []adviseOp
+	a.mu.Lock()
+	f := a.f
+	if f != nil && a.mode&AdviseDontNeed != 0 {
+		ops = a.flush(ops)
+	}
+	a.mu.Unlock()
+	issue(f, ops)
+}
+
+// Close releases the file descriptor duplicated by NewAdvisor, if any. The
+// Advisor does nothing after Close.
+func (a *Advisor) Close() (err error) {
+	a.mu.Lock()
+	f, owned := a.f, a.owned
+	a.f, a.owned = nil, false
+	a.mu.Unlock()
+	if owned {
+		err = f.Close()
+	}
+	return
+}
+
+func issue(f *os.File, ops []adviseOp) {
+	for _, op := range ops {
+		if op.behind {
+			writeBehind(f, op.off, op.n)
+			continue
+		}
+
+		fadvise(f, op.off, op.n, op.advice)
+	}
+}
+
+// written extends the pending written range to cover off and n. Pages written
+// back in any order coalesce as long as the range doesn't exceed
+// adviseBatch, otherwise the pending range is flushed first.
+func (a *Advisor) written(ops []adviseOp, off, n int64) []adviseOp {
+	lo, hi := off, off+n
+	if a.wr1 > a.wr0 {
+		if a.wr0 < lo {
+			lo = a.wr0
+		}
+		if a.wr1 > hi {
+			hi = a.wr1
+		}
+		if hi-lo > adviseBatch {
+			ops = a.flush(ops)
+			lo, hi = off, off+n
+		}
+	}
+	if a.wr0, a.wr1 = lo, hi; hi-lo >= adviseBatch {
+		ops = a.flush(ops)
+	}
+	return ops
+}
+
+// flush starts writing back the pending written range and drops the range
+// written back before, which had time to reach the disk meanwhile.
+func (a *Advisor) flush(ops []adviseOp) []adviseOp {
+	if a.dn1 > a.dn0 {
+		ops = append(ops, adviseOp{off: a.dn0, n: a.dn1 - a.dn0, advice: fileutil.POSIX_FADV_DONTNEED})
+	}
+	a.dn0, a.dn1 = a.wr0, a.wr1
+	if a.wr1 > a.wr0 {
+		ops = append(ops, adviseOp{off: a.wr0, n: a.wr1 - a.wr0, behind: true})
+	}
+	a.wr0, a.wr1 = 0, 0
+	return ops
+}
+
+func (a *Advisor) loaded(ops []adviseOp, off, n int64) []adviseOp {
+	if off != a.next {
+		a.seq, a.ahead, a.n = 0, 0, adviseAheadMin
+	}
+	a.next = off + n
+	if a.seq++; a.seq < adviseSeqMin || a.next < a.ahead {
+		return ops
+	}
+
+	ops = append(ops, adviseOp{off: a.next, n: a.n, advice: fileutil.POSIX_FADV_WILLNEED})
+	a.ahead = a.next + a.n
+	if a.n *= adviseAheadMult; a.n > adviseAheadMax {
+		a.n = adviseAheadMax
+	}
+	return ops
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package storage
+
+import (
+	"os"
+)
+
+// dupFile returns nil, file descriptors cannot be duplicated portably.
+func dupFile(fd uintptr, name string) *os.File {
+	return nil
+}
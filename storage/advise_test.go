@@ -0,0 +1,223 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/cznic/fileutil"
+)
+
+type adviseCall struct {
+	off, n int64
+	advice fileutil.FadviseAdvice // -1 for writeBehind
+}
+
+func TestAdvisor(t *testing.T) {
+	dir, _, f := newfile(t)
+	defer os.RemoveAll(dir)
+	defer f.Close()
+
+	if a := NewAdvisor(f, 0); a.f != nil {
+		t.Fatal(10)
+	}
+
+	if a := NewAdvisor(NewCrashSim("sim", nil, nil), AdviseDontNeed); a.f != nil {
+		t.Fatal(20)
+	}
+
+	if g, owned := osFile(NewProbe(f, nil)); g != f.(*FileAccessor).File || owned {
+		t.Fatal(40, g, owned)
+	}
+
+	// A duplicate descriptor is closed by Close.
+	a := NewAdvisor(fdAccessor{f}, AdviseDontNeed)
+	switch g := a.f; {
+	case g == nil:
+		if runtime.GOOS == "linux" {
+			t.Fatal(41)
+		}
+	case g.Fd() == f.(*FileAccessor).Fd() || g.Name() != f.Name() || !a.owned:
+		t.Fatal(42, g.Fd(), g.Name())
+	default:
+		if err := a.Close(); err != nil {
+			t.Fatal(43, err)
+		}
+
+		if err := g.Close(); err == nil {
+			t.Fatal(44)
+		}
+
+		a.Advise(0, 512, true) // Does nothing.
+		a.Flush()
+	}
+
+	var calls []adviseCall
+	saveF, saveW := fadvise, writeBehind
+	defer func() { fadvise, writeBehind = saveF, saveW }()
+
+	fadvise = func(_ *os.File, off, n int64, advice fileutil.FadviseAdvice) error {
+		calls = append(calls, adviseCall{off, n, advice})
+		return nil
+	}
+	writeBehind = func(_ *os.File, off, n int64) error {
+		calls = append(calls, adviseCall{off, n, -1})
+		return nil
+	}
+
+	// Write backs.
+	a = NewAdvisor(f, AdviseDontNeed)
+	for off := int64(0); off < 2*adviseBatch; off += 512 {
+		a.Advise(off, 512, true)
+		a.Advise(off, 512, false) // Ignored.
+	}
+	a.Advise(1<<30, 512, true)
+	a.Flush() // End of the write back pass.
+	a.Flush() // Close.
+	e := []adviseCall{
+		{0, adviseBatch, -1},
+		{0, adviseBatch, fileutil.POSIX_FADV_DONTNEED},
+		{adviseBatch, adviseBatch, -1},
+		{adviseBatch, adviseBatch, fileutil.POSIX_FADV_DONTNEED},
+		{1 << 30, 512, -1},
+		{1 << 30, 512, fileutil.POSIX_FADV_DONTNEED},
+	}
+	if !equalCalls(calls, e) {
+		t.Fatal(50, calls, e)
+	}
+
+	// Pages written back out of order coalesce.
+	calls = nil
+	a = NewAdvisor(f, AdviseDontNeed)
+	for _, off := range []int64{4096, 0, 2048, 1024} {
+		a.Advise(off, 512, true)
+	}
+	a.Flush()
+	if e = []adviseCall{{0, 4608, -1}}; !equalCalls(calls, e) {
+		t.Fatal(55, calls, e)
+	}
+
+	// Sequential loads.
+	calls = nil
+	a = NewAdvisor(f, AdviseReadahead)
+	a.Advise(1<<20, 512, false)
+	for off := int64(0); off < 1<<17; off += 512 {
+		a.Advise(off, 512, false)
+		a.Advise(off, 512, true) // Ignored.
+	}
+	a.Flush() // Ignored.
+	e = []adviseCall{
+		{2048, adviseAheadMin, fileutil.POSIX_FADV_WILLNEED},
+		{2048 + adviseAheadMin, 2 * adviseAheadMin, fileutil.POSIX_FADV_WILLNEED},
+	}
+	if !equalCalls(calls, e) {
+		t.Fatal(60, calls, e)
+	}
+
+	// With a Cache.
+	calls = nil
+	c, err := NewCache(f, 1<<20, nil)
+	if err != nil {
+		t.Fatal(70, err)
+	}
+
+	a = NewAdvisor(f, AdviseDontNeed|AdviseReadahead)
+	c.SetAdvisor(a)
+
+	b := make([]byte, 1<<19)
+	if _, err = c.WriteAt(b, 0); err != nil {
+		t.Fatal(80, err)
+	}
+
+	if err = c.Sync(); err != nil {
+		t.Fatal(90, err)
+	}
+
+	if len(calls) == 0 {
+		t.Fatal(100)
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(110, err)
+	}
+
+	if g := calls[len(calls)-1]; g.advice != fileutil.POSIX_FADV_DONTNEED {
+		t.Fatal(120, calls)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatal(130, err)
+	}
+}
+
+func TestCacheAdvise(t *testing.T) {
+	dir, _, f := newfile(t)
+	defer os.RemoveAll(dir)
+
+	b := make([]byte, 1024)
+	if _, err := f.WriteAt(b, 0); err != nil {
+		t.Fatal(10, err)
+	}
+
+	// The advise function of NewCache is invoked under the lock of the
+	// Cache and only with pages.
+	var c *Cache
+	var calls []adviseCall
+	c, err := NewCache(f, 1<<20, func(off int64, n int, write bool) {
+		if c.lock.TryLock() {
+			c.lock.Unlock()
+			t.Error(20)
+		}
+		var advice fileutil.FadviseAdvice
+		if write {
+			advice = -1
+		}
+		calls = append(calls, adviseCall{off, int64(n), advice})
+	})
+	if err != nil {
+		t.Fatal(30, err)
+	}
+
+	if _, err = c.ReadAt(b, 0); err != nil {
+		t.Fatal(40, err)
+	}
+
+	if _, err = c.WriteAt(b, 0); err != nil {
+		t.Fatal(50, err)
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(60, err)
+	}
+
+	e := []adviseCall{{0, 512, 0}, {512, 512, 0}, {0, 512, -1}, {512, 512, -1}}
+	if !equalCalls(calls, e) {
+		t.Fatal(70, calls, e)
+	}
+}
+
+// fdAccessor is an Accessor of a foreign type having a file descriptor.
+type fdAccessor struct {
+	Accessor
+}
+
+func (a fdAccessor) Fd() uintptr {
+	return a.Accessor.(*FileAccessor).Fd()
+}
+
+func equalCalls(g, e []adviseCall) bool {
+	if len(g) != len(e) {
+		return false
+	}
+
+	for i, v := range g {
+		if v != e[i] {
+			return false
+		}
+	}
+	return true
+}
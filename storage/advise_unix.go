@@ -0,0 +1,24 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// dupFile returns an os.File of a duplicate of fd, which remains owned by its
+// caller, or nil if fd cannot be duplicated.
+func dupFile(fd uintptr, name string) *os.File {
+	dup, err := syscall.Dup(int(fd))
+	if err != nil {
+		return nil
+	}
+
+	syscall.CloseOnExec(dup)
+	return os.NewFile(uintptr(dup), name)
+}
@@ -8,11 +8,15 @@ package storage
 
 import (
 	"container/list"
+	"errors"
+	"fmt"
 	"io"
 	"math"
 	"os"
 	"sync"
 	"sync/atomic"
+
+	"github.com/cznic/fileutil"
 )
 
 type cachepage struct {
@@ -33,7 +37,9 @@ func (p *cachepage) wr(b []byte, off int) (wasDirty bool) {
 	return
 }
 
-func (c *Cache) rd(off int64, read bool) (p *cachepage, ok bool) {
+// rd returns the cached page at off, loading it from the underlying store if
+// read is true. Errors of the load are returned. The caller holds c.lock.
+func (c *Cache) rd(off int64, read bool) (p *cachepage, ok bool, err error) {
 	c.Rq++
 	pi := off >> 9
 	if p, ok = c.m[pi]; ok {
@@ -46,31 +52,37 @@ func (c *Cache) rd(off int64, read bool) (p *cachepage, ok bool) {
 	}
 
 	fp := off &^ 511
-	if fp >= c.size {
+	if fp >= c.csize {
 		return
 	}
 
 	rq := 512
-	if fp+512 > c.size {
-		rq = int(c.size - fp)
+	if fp+512 > c.csize {
+		rq = int(c.csize - fp)
 	}
 	p = &cachepage{pi: pi, valid: rq}
-	p.lru = c.lru.PushBack(p)
-	if n, err := c.f.ReadAt(p.b[:p.valid], fp); n != rq {
-		panic(err)
+	if n, e := c.f.ReadAt(p.b[:p.valid], fp); n != rq {
+		if err = e; err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, err
 	}
 
+	p.lru = c.lru.PushBack(p)
 	c.Load++
 	if c.advise != nil {
 		c.advise(fp, 512, false)
 	}
+	if c.advisor != nil {
+		c.loads = append(c.loads, fp)
+	}
 	c.m[pi], ok = p, true
 	return
 }
 
 func (c *Cache) wr(off int64) (p *cachepage) {
 	var ok bool
-	if p, ok = c.rd(off, false); ok {
+	if p, ok, _ = c.rd(off, false); ok {
 		return
 	}
 
@@ -81,20 +93,50 @@ func (c *Cache) wr(off int64) (p *cachepage) {
 	return
 }
 
+// unlock unlocks c.lock and then notifies the advisor of the pages loaded
+// while holding it, so that the advisor never blocks other users of c.
+func (c *Cache) unlock() {
+	a, loads := c.advisor, c.loads
+	c.loads = nil
+	c.lock.Unlock()
+	for _, off := range loads {
+		a.Advise(off, 512, false)
+	}
+}
+
 // Cache provides caching support for another store Accessor.
+//
+// Cache implements Rollbacker. Pages written in an update are kept aside and
+// become subject to write back only when the outermost update ends. A Rollback
+// simply forgets them.
+//
+// Dirty pages are written back by a background goroutine. If writing a page
+// back fails, the page stays dirty and is retried later, the error is recorded
+// and it's returned by the next Sync, WriteAt or Close. See also
+// SetErrorHandler.
 type Cache struct {
 	advise   func(int64, int, bool)
+	advisor  CacheAdvisor
 	clean    chan bool
 	cleaning int32
 	close    chan bool
+	csize    int64 // committed size
+	err      error // recorded write back error
 	f        Accessor
+	failed   bool // a nested update was rolled back
 	fi       *FileInfo
+	loads    []int64 // pages loaded and not yet advised
 	lock     sync.Mutex
 	lru      *list.List
 	m        map[int64]*cachepage
 	maxpages int
+	nest     int
+	onError  func(error)
 	size     int64
 	sync     chan bool
+	tx       map[int64]*cachepage // pages written by the current update
+	txmin    int64                // minimal size during the current update
+	werr     error                // error of the last page write back, if any
 	wlist    *list.List
 	write    chan bool
 	writing  int32
@@ -105,16 +147,213 @@ type Cache struct {
 }
 
 // Implementation of Accessor.
-func (c *Cache) BeginUpdate() error { return nil }
+func (c *Cache) BeginUpdate() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.nest == 0 {
+		c.tx = map[int64]*cachepage{}
+		c.txmin = c.csize
+	}
+	c.nest++
+	return nil
+}
 
 // Implementation of Accessor.
-func (c *Cache) EndUpdate() error { return nil }
+func (c *Cache) EndUpdate() error {
+	return c.end(false)
+}
+
+// Implementation of Rollbacker.
+func (c *Cache) Rollback() error {
+	return c.end(true)
+}
+
+func (c *Cache) end(rollback bool) (err error) {
+	c.lock.Lock()
+	if c.nest == 0 {
+		c.lock.Unlock()
+		return errors.New("update not in progress")
+	}
+
+	c.failed = c.failed || rollback
+	if c.nest--; c.nest != 0 {
+		c.lock.Unlock()
+		return
+	}
+
+	if c.failed {
+		c.failed = false
+		c.tx = nil
+		c.size = c.csize
+		c.lock.Unlock()
+		if !rollback {
+			err = ErrRolledBack
+		}
+		return
+	}
+
+	dirty, err := c.commit()
+	c.lock.Unlock()
+	if dirty && atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+		c.write <- true
+	}
+	return
+}
+
+// commit makes the pages written in the current update subject to write
+// back. The caller holds c.lock.
+func (c *Cache) commit() (dirty bool, err error) {
+	tx := c.tx
+	c.tx = nil
+	if c.txmin < c.csize {
+		if err = c.cut(c.txmin); err != nil {
+			c.size = c.csize
+			return
+		}
+	}
+
+	for pi, p := range tx {
+		q := c.wr(pi << 9)
+		q.b, q.valid = p.b, p.valid
+		if !q.dirty {
+			q.dirty = true
+			c.wlist.PushBack(q)
+		}
+		dirty = true
+	}
+	c.csize = c.size
+	return
+}
+
+// cut discards any cached content at or beyond size and truncates the
+// underlying store to size. The caller holds c.lock.
+func (c *Cache) cut(size int64) (err error) {
+	for item := c.wlist.Front(); item != nil; {
+		next := item.Next()
+		if p := item.Value.(*cachepage); p.pi<<9 >= size {
+			p.dirty = false
+			c.wlist.Remove(item)
+		}
+		item = next
+	}
+	drop := func(p *cachepage) {
+		fp := p.pi << 9
+		if fp >= size {
+			delete(c.m, p.pi)
+			c.lru.Remove(p.lru)
+			return
+		}
+
+		if n := size - fp; n < int64(p.valid) {
+			for i := int(n); i < p.valid; i++ {
+				p.b[i] = 0
+			}
+			p.valid = int(n)
+		}
+	}
+	if first, last := size>>9, (c.csize+511)>>9; last-first < int64(len(c.m)) {
+		for pi := first; pi < last; pi++ {
+			if p, ok := c.m[pi]; ok {
+				drop(p)
+			}
+		}
+	} else {
+		for _, p := range c.m {
+			drop(p)
+		}
+	}
+	c.csize = size
+	return c.f.Truncate(size)
+}
+
+// txpage returns the page to be written at off in the current update. The
+// caller holds c.lock.
+func (c *Cache) txpage(off int64) (p *cachepage, err error) {
+	pi := off >> 9
+	if p = c.tx[pi]; p != nil {
+		return
+	}
+
+	p = &cachepage{pi: pi}
+	if fp := pi << 9; fp < c.txmin {
+		q, ok, err := c.rd(off, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			p.b, p.valid = q.b, q.valid
+			if n := c.txmin - fp; n < int64(p.valid) {
+				for i := int(n); i < p.valid; i++ {
+					p.b[i] = 0
+				}
+				p.valid = int(n)
+			}
+		}
+	}
+	c.tx[pi] = p
+	return
+}
+
+// txread is ReadAt in an update.
+func (c *Cache) txread(b []byte, off int64) (n int, err error) {
+	c.lock.Lock()
+	defer c.unlock()
+	if n = len(b); off+int64(n) > c.size {
+		if n = int(c.size - off); n < 0 {
+			n = 0
+		}
+		err = io.EOF
+	}
+	for bp := 0; bp < n; {
+		po := int(off+int64(bp)) & 0x1ff
+		rq := n - bp
+		if po+rq > 512 {
+			rq = 512 - po
+		}
+		dst := b[bp : bp+rq]
+		fp := off + int64(bp)
+		switch p, ok := c.tx[fp>>9]; {
+		case ok:
+			copy(dst, p.b[po:])
+		case fp < c.txmin:
+			var k int
+			p, ok, e := c.rd(fp, true)
+			if e != nil {
+				return bp, e
+			}
+
+			if ok {
+				valid := p.valid
+				if m := int(c.txmin - fp&^511); m < valid {
+					valid = m
+				}
+				if po < valid {
+					k = copy(dst, p.b[po:valid])
+				}
+			}
+			for i := k; i < rq; i++ {
+				dst[i] = 0
+			}
+		default:
+			for i := range dst {
+				dst[i] = 0
+			}
+		}
+		bp += rq
+	}
+	return
+}
 
 // NewCache creates a caching Accessor from store with total of maxcache bytes.
 // NewCache returns the new Cache, implementing Accessor or an error if any.
 //
 // The LRU mechanism is used, so the cache tries to keep often accessed pages cached.
 //
+// If advise is not nil, it's invoked with the offset and size of every page
+// loaded from store, write == false, and of every page written back to store,
+// write == true. Advise is invoked while holding the lock of the Cache, so the
+// calls are serialized. See also SetAdvisor.
 func NewCache(store Accessor, maxcache int64, advise func(int64, int, bool)) (c *Cache, err error) {
 	var fi os.FileInfo
 	if fi, err = store.Stat(); err != nil {
@@ -133,6 +372,7 @@ func NewCache(store Accessor, maxcache int64, advise func(int64, int, bool)) (c
 		lru:      list.New(), // front == oldest used, back == last recently used
 		m:        make(map[int64]*cachepage),
 		maxpages: int(x),
+		csize:    fi.Size(),
 		size:     fi.Size(),
 		sync:     make(chan bool),
 		wlist:    list.New(),
@@ -148,12 +388,61 @@ func (c *Cache) Accessor() Accessor {
 	return c.f
 }
 
+// Close commits any pending, not doomed updates, writes back all dirty pages
+// and closes the underlying store.
 func (c *Cache) Close() (err error) {
+	c.lock.Lock()
+	if c.tx != nil && !c.failed {
+		_, err = c.commit()
+	}
+	c.lock.Unlock()
 	close(c.write)
 	<-c.close
 	close(c.clean)
 	<-c.close
-	return c.f.Close()
+	c.lock.Lock()
+	a := c.advisor
+	c.lock.Unlock()
+	if a != nil {
+		a.Flush() // the last pass is over
+	}
+	if e := c.takeErr(); e != nil && err == nil {
+		err = e
+	}
+	if e := c.f.Close(); e != nil && err == nil {
+		err = e
+	}
+	return
+}
+
+// SetErrorHandler sets h to be invoked from the write back goroutine with
+// every error of writing a dirty page to the underlying store. The error is
+// still recorded and returned by the next Sync, WriteAt or Close. While write
+// backs are failing, h is also invoked when the cache cannot be shrunk to its
+// limit, because all of the cached pages are dirty. h must not call methods of
+// c. Passing nil removes the handler.
+func (c *Cache) SetErrorHandler(h func(error)) {
+	c.lock.Lock()
+	c.onError = h
+	c.lock.Unlock()
+}
+
+// SetAdvisor sets a to be notified of the page loads and write backs of c,
+// see CacheAdvisor and NewAdvisor. Unlike the advise function of NewCache, a
+// is never invoked while holding the lock of c. Passing nil removes the
+// advisor.
+func (c *Cache) SetAdvisor(a CacheAdvisor) {
+	c.lock.Lock()
+	c.advisor = a
+	c.lock.Unlock()
+}
+
+// takeErr returns and clears the recorded write back error.
+func (c *Cache) takeErr() (err error) {
+	c.lock.Lock()
+	err, c.err = c.err, nil
+	c.lock.Unlock()
+	return
 }
 
 func (c *Cache) Name() (s string) {
@@ -161,15 +450,27 @@ func (c *Cache) Name() (s string) {
 }
 
 func (c *Cache) ReadAt(b []byte, off int64) (n int, err error) {
+	c.lock.Lock()
+	tx := c.tx != nil
+	c.lock.Unlock()
+	if tx {
+		return c.txread(b, off)
+	}
+
 	po := int(off) & 0x1ff
 	bp := 0
 	rem := len(b)
 	m := 0
 	for rem != 0 {
 		c.lock.Lock() // X1+
-		p, ok := c.rd(off, true)
+		p, ok, err := c.rd(off, true)
+		if err != nil {
+			c.unlock() // X1-
+			return n, err
+		}
+
 		if !ok {
-			c.lock.Unlock() // X1-
+			c.unlock() // X1-
 			return -1, io.EOF
 		}
 
@@ -178,12 +479,12 @@ func (c *Cache) ReadAt(b []byte, off int64) (n int, err error) {
 			rq = 512 - po
 		}
 		if n := copy(b[bp:bp+rq], p.b[po:p.valid]); n != rq {
-			c.lock.Unlock() // X1-
+			c.unlock() // X1-
 			return -1, io.EOF
 		}
 
 		m = len(c.m)
-		c.lock.Unlock() // X1-
+		c.unlock() // X1-
 		po = 0
 		bp += rq
 		off += int64(rq)
@@ -202,37 +503,74 @@ func (c *Cache) ReadAt(b []byte, off int64) (n int, err error) {
 func (c *Cache) Stat() (fi os.FileInfo, err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	c.fi.FSize = c.size
 	return c.fi, nil
 }
 
 func (c *Cache) Sync() (err error) {
 	c.write <- false
 	<-c.sync
-	return
+	return c.takeErr()
 }
 
 func (c *Cache) Truncate(size int64) (err error) {
-	c.Sync() //TODO improve (discard pages, the writer goroutine should also be aware, ...)
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	if c.tx != nil {
+		for pi, p := range c.tx {
+			fp := pi << 9
+			if fp >= size {
+				delete(c.tx, pi)
+				continue
+			}
+
+			if n := size - fp; n < int64(p.valid) {
+				for i := int(n); i < p.valid; i++ {
+					p.b[i] = 0
+				}
+				p.valid = int(n)
+			}
+		}
+		if size < c.txmin {
+			c.txmin = size
+		}
+		c.size = size
+		return
+	}
+
 	c.size = size
-	return c.f.Truncate(size)
+	return c.cut(size)
 }
 
 func (c *Cache) WriteAt(b []byte, off int64) (n int, err error) {
+	if err = c.takeErr(); err != nil {
+		return
+	}
+
 	po := int(off) & 0x1ff
 	bp := 0
 	rem := len(b)
 	m := 0
+	tx := false
 	for rem != 0 {
 		c.lock.Lock() // X+
-		p := c.wr(off)
 		rq := rem
 		if po+rq > 512 {
 			rq = 512 - po
 		}
-		if wasDirty := p.wr(b[bp:bp+rq], po); !wasDirty {
-			c.wlist.PushBack(p)
+		if tx = c.tx != nil; tx {
+			p, err := c.txpage(off)
+			if err != nil {
+				c.unlock() // X-
+				return n, err
+			}
+
+			p.wr(b[bp:bp+rq], po)
+		} else {
+			p := c.wr(off)
+			if wasDirty := p.wr(b[bp:bp+rq], po); !wasDirty {
+				c.wlist.PushBack(p)
+			}
 		}
 		m = len(c.m)
 		po = 0
@@ -241,11 +579,14 @@ func (c *Cache) WriteAt(b []byte, off int64) (n int, err error) {
 		if off > c.size {
 			c.size = off
 		}
-		c.lock.Unlock() // X-
+		if !tx && off > c.csize {
+			c.csize = off
+		}
+		c.unlock() // X-
 		rem -= rq
 		n += rq
 	}
-	if atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+	if !tx && atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
 		c.write <- true
 	}
 	if m > c.maxpages && atomic.CompareAndSwapInt32(&c.cleaning, 0, 1) {
@@ -257,10 +598,83 @@ func (c *Cache) WriteAt(b []byte, off int64) (n int, err error) {
 	return
 }
 
+// PunchHole implements PunchHoler. Dirty pages are written back first, then
+// cached content of the range is zeroed and pages completely within the range
+// are dropped. The range is then punched in the underlying store. PunchHole
+// fails if an update is in progress.
+func (c *Cache) PunchHole(off, size int64) (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.nest != 0 {
+		return errors.New("PunchHole: update in progress")
+	}
+
+	for item := c.wlist.Front(); item != nil; item = c.wlist.Front() {
+		p := item.Value.(*cachepage)
+		if err = c.writePage(p); err != nil {
+			return
+		}
+
+		p.dirty = false
+		c.wlist.Remove(item)
+	}
+
+	end := off + size
+	punch := func(p *cachepage) {
+		fp := p.pi << 9
+		if fp >= off && fp+512 <= end {
+			delete(c.m, p.pi)
+			c.lru.Remove(p.lru)
+			return
+		}
+
+		from, to := off-fp, end-fp
+		if from < 0 {
+			from = 0
+		}
+		if to > int64(p.valid) {
+			to = int64(p.valid)
+		}
+		for i := from; i < to; i++ {
+			p.b[i] = 0
+		}
+	}
+	if first, last := off>>9, (end+511)>>9; last-first < int64(len(c.m)) {
+		for pi := first; pi < last; pi++ {
+			if p, ok := c.m[pi]; ok {
+				punch(p)
+			}
+		}
+	} else {
+		for _, p := range c.m {
+			if fp := p.pi << 9; fp < end && fp+512 > off {
+				punch(p)
+			}
+		}
+	}
+	return PunchHole(c.f, off, size)
+}
+
+// Preallocate implements Preallocator by forwarding to the underlying store.
+func (c *Cache) Preallocate(off, size int64) error {
+	return Preallocate(c.f, off, size)
+}
+
+// TryLock implements FileLocker by forwarding to the underlying store.
+func (c *Cache) TryLock(mode fileutil.LockMode) error {
+	return TryLock(c.f, mode)
+}
+
+// Unlock implements FileLocker by forwarding to the underlying store.
+func (c *Cache) Unlock() error {
+	return Unlock(c.f)
+}
+
 func (c *Cache) writer() {
 	for ok := true; ok; {
 		var wr bool
 		var off int64
+		var advisor CacheAdvisor // notified of the pages written in this pass
 		wr, ok = <-c.write
 		for {
 			c.lock.Lock() // X1+
@@ -272,18 +686,31 @@ func (c *Cache) writer() {
 
 			p := item.Value.(*cachepage)
 			off = p.pi << 9
-			if n, err := c.f.WriteAt(p.b[:p.valid], off); n != p.valid {
-				c.lock.Unlock()                    // X1-
-				panic("TODO Cache.writer errchan") //TODO +errchan
-				panic(err)
+			if err := c.writePage(p); err != nil {
+				c.err, c.werr = err, err
+				h := c.onError
+				c.lock.Unlock() // X1-
+				if h != nil {
+					h(err)
+				}
+				break
 			}
 
 			p.dirty = false
 			c.wlist.Remove(item)
+			c.werr = nil
 			if c.advise != nil {
 				c.advise(off, 512, true)
 			}
+			a := c.advisor
 			c.lock.Unlock() // X1-
+			if a != nil {
+				a.Advise(off, 512, true)
+				advisor = a
+			}
+		}
+		if advisor != nil {
+			advisor.Flush() // end of the pass
 		}
 		switch {
 		case wr:
@@ -295,9 +722,19 @@ func (c *Cache) writer() {
 	c.close <- true
 }
 
+// writePage writes p to the underlying store. The caller holds c.lock.
+func (c *Cache) writePage(p *cachepage) (err error) {
+	n, err := c.f.WriteAt(p.b[:p.valid], p.pi<<9)
+	if n != p.valid && err == nil {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
 func (c *Cache) cleaner(limit int) {
 	for _ = range c.clean {
 		var item *list.Element
+		purged := true // by the current pass over c.lru
 		for {
 			c.lock.Lock() // X1+
 			if len(c.m) < limit {
@@ -306,14 +743,28 @@ func (c *Cache) cleaner(limit int) {
 			}
 
 			if item == nil {
-				item = c.lru.Front()
+				if !purged {
+					// Only dirty pages are left. Give up until the
+					// cache grows again instead of spinning, the
+					// writer is behind or failing.
+					werr, h := c.werr, c.onError
+					c.lock.Unlock() // X1-
+					if werr != nil && h != nil {
+						h(fmt.Errorf("Cache %s: cannot evict dirty pages: %v", c.f.Name(), werr))
+					}
+					break
+				}
+
+				item, purged = c.lru.Front(), false
 			}
+			next := item.Next()
 			if p := item.Value.(*cachepage); !p.dirty {
 				delete(c.m, p.pi)
 				c.lru.Remove(item)
 				c.Purge++
+				purged = true
 			}
-			item = item.Next()
+			item = next
 			c.lock.Unlock() // X1-
 		}
 		atomic.AddInt32(&c.cleaning, -1)
@@ -7,10 +7,15 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func newfile(t *testing.T) (string, string, Accessor) {
@@ -81,3 +86,260 @@ func TestCache1(t *testing.T) {
 		t.Fatal(40, b[0], 0xa5)
 	}
 }
+
+func TestCacheRollback(t *testing.T) {
+	dir, name, c := newcache(t)
+	defer os.RemoveAll(dir)
+
+	if n, err := c.WriteAt(bytes.Repeat([]byte{0xa5}, 1000), 0); n != 1000 {
+		t.Fatal(10, n, err)
+	}
+
+	e := errors.New("fail")
+	if err := Mutate(c, func() error {
+		if n, err := c.WriteAt([]byte{1, 2}, 510); n != 2 {
+			t.Fatal(20, n, err)
+		}
+
+		if err := c.Truncate(511); err != nil {
+			t.Fatal(30, err)
+		}
+
+		if n, err := c.WriteAt([]byte{3}, 600); n != 1 {
+			t.Fatal(40, n, err)
+		}
+
+		b := make([]byte, 4)
+		if n, err := c.ReadAt(b, 509); n != 4 {
+			t.Fatal(50, n, err)
+		}
+
+		if g, e := b, []byte{0xa5, 1, 0, 0}; !bytes.Equal(g, e) {
+			t.Fatal(60, g, e)
+		}
+
+		return e
+	}); err != e {
+		t.Fatal(70, err, e)
+	}
+
+	fi, err := c.Stat()
+	if err != nil {
+		t.Fatal(80, err)
+	}
+
+	if g, e := fi.Size(), int64(1000); g != e {
+		t.Fatal(90, g, e)
+	}
+
+	if err := Mutate(c, func() error {
+		_, err := c.WriteAt([]byte{4}, 999)
+		return err
+	}); err != nil {
+		t.Fatal(100, err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(110, err)
+	}
+
+	b := readfile(t, name)
+	e2 := bytes.Repeat([]byte{0xa5}, 1000)
+	e2[999] = 4
+	if !bytes.Equal(b, e2) {
+		t.Fatal(120, len(b), b[505:515], b[995:])
+	}
+}
+
+func TestCachePunchHole(t *testing.T) {
+	dir, name, c := newcache(t)
+	defer os.RemoveAll(dir)
+
+	b := bytes.Repeat([]byte{0xa5}, 1<<13)
+	if n, err := c.WriteAt(b, 0); n != len(b) {
+		t.Fatal(10, n, err)
+	}
+
+	if err := c.PunchHole(1000, 3000); err != nil {
+		t.Fatal(20, err)
+	}
+
+	for i := 1000; i < 4000; i++ {
+		b[i] = 0
+	}
+	g := make([]byte, len(b))
+	if n, err := c.ReadAt(g, 0); n != len(g) {
+		t.Fatal(30, n, err)
+	}
+
+	if !bytes.Equal(g, b) {
+		t.Fatal(40)
+	}
+
+	if err := c.Preallocate(0, 1<<16); err != nil {
+		t.Fatal(50, err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(60, err)
+	}
+
+	if !bytes.Equal(readfile(t, name), b) {
+		t.Fatal(70)
+	}
+}
+
+var errFail = errors.New("injected failure")
+
+// failAccessor fails ReadAt and/or WriteAt of the embeded Accessor on demand.
+type failAccessor struct {
+	Accessor
+	rd, wr int32
+}
+
+func (f *failAccessor) ReadAt(b []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&f.rd) != 0 {
+		return 0, errFail
+	}
+
+	return f.Accessor.ReadAt(b, off)
+}
+
+func (f *failAccessor) WriteAt(b []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&f.wr) != 0 {
+		return 0, errFail
+	}
+
+	return f.Accessor.WriteAt(b, off)
+}
+
+func TestCacheErrors(t *testing.T) {
+	dir, name, f := newfile(t)
+	defer os.RemoveAll(dir)
+
+	b := bytes.Repeat([]byte{0xa5}, 1000)
+	if n, err := f.WriteAt(b, 0); n != len(b) {
+		t.Fatal(10, n, err)
+	}
+
+	fa := &failAccessor{Accessor: f}
+	c, err := NewCache(fa, 1<<20, nil)
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	handled := make(chan error, 16)
+	c.SetErrorHandler(func(err error) { handled <- err })
+
+	atomic.StoreInt32(&fa.rd, 1)
+	g := make([]byte, len(b))
+	if _, err := c.ReadAt(g, 0); err != errFail {
+		t.Fatal(30, err)
+	}
+
+	atomic.StoreInt32(&fa.rd, 0)
+	if n, err := c.ReadAt(g, 0); n != len(g) || !bytes.Equal(g, b) {
+		t.Fatal(40, n, err)
+	}
+
+	atomic.StoreInt32(&fa.wr, 1)
+	if n, err := c.WriteAt([]byte{1, 2, 3}, 10); n != 3 {
+		t.Fatal(50, n, err)
+	}
+
+	if err := c.Sync(); err != errFail {
+		t.Fatal(60, err)
+	}
+
+	if err := <-handled; err != errFail {
+		t.Fatal(70, err)
+	}
+
+	// The page stays dirty and is written back once the store recovers.
+	atomic.StoreInt32(&fa.wr, 0)
+	if err := c.Sync(); err != nil {
+		t.Fatal(80, err)
+	}
+
+	for len(handled) != 0 {
+		<-handled
+	}
+
+	copy(b[10:], []byte{1, 2, 3})
+	if !bytes.Equal(readfile(t, name), b) {
+		t.Fatal(90)
+	}
+
+	atomic.StoreInt32(&fa.wr, 1)
+	if n, err := c.WriteAt([]byte{4}, 20); n != 1 {
+		t.Fatal(100, n, err)
+	}
+
+	<-handled
+	if n, err := c.WriteAt([]byte{5}, 30); n != 0 || err != errFail {
+		t.Fatal(110, n, err)
+	}
+
+	if err := c.Close(); err != errFail {
+		t.Fatal(120, err)
+	}
+}
+
+func TestCacheDirtyFull(t *testing.T) {
+	dir, name, f := newfile(t)
+	defer os.RemoveAll(dir)
+
+	fa := &failAccessor{Accessor: f}
+	c, err := NewCache(fa, 1<<13, nil)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	handled := make(chan error, 1)
+	c.SetErrorHandler(func(err error) {
+		select {
+		case handled <- err:
+		default:
+		}
+	})
+
+	atomic.StoreInt32(&fa.wr, 1)
+	b := make([]byte, 1<<15)
+	if n, err := c.WriteAt(b, 0); n != len(b) {
+		t.Fatal(20, n, err)
+	}
+
+	// All of the pages are dirty, the cleaner reports it and gives up.
+	deadline := time.After(5 * time.Second)
+	for full := false; !full; {
+		c.ReadAt(b[:1], 0)
+		select {
+		case err := <-handled:
+			full = strings.Contains(err.Error(), "cannot evict")
+		case <-deadline:
+			t.Fatal(30)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	for atomic.LoadInt32(&c.cleaning) != 0 {
+		select {
+		case <-deadline:
+			t.Fatal(40)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	atomic.StoreInt32(&fa.wr, 0)
+	c.Sync() // Returns the recorded error.
+	if err = c.Sync(); err != nil {
+		t.Fatal(50, err)
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(60, err)
+	}
+
+	if g, e := len(readfile(t, name)), len(b); g != e {
+		t.Fatal(70, g, e)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	crashWrite = iota
+	crashTruncate
+	crashSync
+)
+
+type crashop struct {
+	sim  *CrashSim
+	kind int
+	off  int64  // write offset or truncate size
+	b    []byte // written data
+}
+
+type crashjournal struct {
+	lock sync.Mutex
+	ops  []crashop
+}
+
+// CrashSim is an in-memory Accessor intended for testing of crash
+// consistency. It records every WriteAt, Truncate and Sync in a journal and
+// is able to reconstruct the store content as it would be found after a power
+// loss at any of the recorded operations, including torn writes of 512 byte
+// sectors.
+//
+// CrashSim implements BeginUpdate and EndUpdate as a no op.
+type CrashSim struct {
+	b       []byte // current content
+	base    []byte // content when created
+	journal *crashjournal
+	name    string
+}
+
+// NewCrashSim returns a new CrashSim named name with initial content b. If
+// peer is not nil, the new CrashSim shares the journal with peer and the
+// operation indexes are thus common to both of them. That allows simulating a
+// crash of a set of files, like a store and its write-ahead log.
+func NewCrashSim(name string, b []byte, peer *CrashSim) *CrashSim {
+	c := &CrashSim{
+		b:       append([]byte(nil), b...),
+		base:    append([]byte(nil), b...),
+		journal: &crashjournal{},
+		name:    name,
+	}
+	if peer != nil {
+		c.journal = peer.journal
+	}
+	return c
+}
+
+func (c *CrashSim) record(kind int, off int64, b []byte) {
+	c.journal.lock.Lock()
+	c.journal.ops = append(c.journal.ops, crashop{c, kind, off, b})
+	c.journal.lock.Unlock()
+}
+
+func (c *CrashSim) op(i int) (op crashop) {
+	c.journal.lock.Lock()
+	defer c.journal.lock.Unlock()
+	if i < 0 || i > len(c.journal.ops) {
+		panic(fmt.Errorf("CrashSim %s: operation index %d out of range", c.name, i))
+	}
+
+	if i < len(c.journal.ops) {
+		op = c.journal.ops[i]
+	}
+	return
+}
+
+// Ops returns the number of operations recorded in the journal.
+func (c *CrashSim) Ops() int {
+	c.journal.lock.Lock()
+	defer c.journal.lock.Unlock()
+	return len(c.journal.ops)
+}
+
+// Sectors returns the number of 512 byte sectors written by operation i. If
+// operation i is not a WriteAt of c then Sectors returns 0.
+func (c *CrashSim) Sectors(i int) int {
+	op := c.op(i)
+	if op.sim != c || op.kind != crashWrite || len(op.b) == 0 {
+		return 0
+	}
+
+	return int((op.off+int64(len(op.b))-1)>>9 - op.off>>9 + 1)
+}
+
+// Image returns the content of c after a crash which happened while operation
+// i was in progress. All of the operations before i have completed, if
+// operation i is a WriteAt of c then its first sectors sectors have made it to
+// the disk.
+func (c *CrashSim) Image(i, sectors int) []byte {
+	c.op(i) // range check
+	b := append([]byte(nil), c.base...)
+	c.journal.lock.Lock()
+	ops := c.journal.ops[:i]
+	var torn crashop
+	if i < len(c.journal.ops) {
+		torn = c.journal.ops[i]
+	}
+	c.journal.lock.Unlock()
+	for _, op := range ops {
+		if op.sim == c {
+			b = crashApply(b, op)
+		}
+	}
+	if torn.sim != c || torn.kind != crashWrite || sectors <= 0 {
+		return b
+	}
+
+	end := torn.off + int64(len(torn.b))
+	if n := (torn.off>>9 + int64(sectors)) << 9; n < end {
+		end = n
+	}
+	torn.b = torn.b[:end-torn.off]
+	return crashApply(b, torn)
+}
+
+// SyncedImage returns the content of c after a crash which happened while
+// operation i was in progress, assuming only the operations of c followed by a
+// Sync of c have made it to the disk.
+func (c *CrashSim) SyncedImage(i int) []byte {
+	c.op(i) // range check
+	b := append([]byte(nil), c.base...)
+	c.journal.lock.Lock()
+	ops := c.journal.ops[:i]
+	c.journal.lock.Unlock()
+	last := 0
+	for j, op := range ops {
+		if op.sim == c && op.kind == crashSync {
+			last = j
+		}
+	}
+	for _, op := range ops[:last] {
+		if op.sim == c {
+			b = crashApply(b, op)
+		}
+	}
+	return b
+}
+
+// Crash returns a new CrashSim, with a new journal, having content
+// Image(i, sectors).
+func (c *CrashSim) Crash(i, sectors int) *CrashSim {
+	return NewCrashSim(c.name, c.Image(i, sectors), nil)
+}
+
+func crashApply(b []byte, op crashop) []byte {
+	switch op.kind {
+	case crashWrite:
+		if end := op.off + int64(len(op.b)); end > int64(len(b)) {
+			b = append(b, make([]byte, end-int64(len(b)))...)
+		}
+		copy(b[op.off:], op.b)
+	case crashTruncate:
+		if op.off <= int64(len(b)) {
+			return b[:op.off]
+		}
+
+		b = append(b, make([]byte, op.off-int64(len(b)))...)
+	}
+	return b
+}
+
+// Implementation of Accessor.
+func (c *CrashSim) BeginUpdate() error { return nil }
+
+// Implementation of Accessor.
+func (c *CrashSim) EndUpdate() error { return nil }
+
+// Close implements Accessor. It's a no op.
+func (c *CrashSim) Close() error {
+	return nil
+}
+
+// Name implements Accessor.
+func (c *CrashSim) Name() string {
+	return c.name
+}
+
+// ReadAt implements Accessor.
+func (c *CrashSim) ReadAt(b []byte, off int64) (n int, err error) {
+	c.journal.lock.Lock()
+	defer c.journal.lock.Unlock()
+	if off < 0 {
+		return 0, fmt.Errorf("CrashSim %s: ReadAt: illegal offset %#x", c.name, off)
+	}
+
+	if off < int64(len(c.b)) {
+		n = copy(b, c.b[off:])
+	}
+	if n != len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+// Stat implements Accessor.
+func (c *CrashSim) Stat() (fi os.FileInfo, err error) {
+	c.journal.lock.Lock()
+	defer c.journal.lock.Unlock()
+	return &FileInfo{FName: c.name, FSize: int64(len(c.b)), FMode: 0666, FModTime: time.Now(), sys: c}, nil
+}
+
+// Sync implements Accessor. It only records the operation.
+func (c *CrashSim) Sync() error {
+	c.record(crashSync, 0, nil)
+	return nil
+}
+
+// Truncate implements Accessor.
+func (c *CrashSim) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("CrashSim %s: Truncate: illegal size %#x", c.name, size)
+	}
+
+	c.record(crashTruncate, size, nil)
+	c.journal.lock.Lock()
+	c.b = crashApply(c.b, crashop{kind: crashTruncate, off: size})
+	c.journal.lock.Unlock()
+	return nil
+}
+
+// WriteAt implements Accessor.
+func (c *CrashSim) WriteAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("CrashSim %s: WriteAt: illegal offset %#x", c.name, off)
+	}
+
+	op := crashop{c, crashWrite, off, append([]byte(nil), b...)}
+	c.record(op.kind, op.off, op.b)
+	c.journal.lock.Lock()
+	c.b = crashApply(c.b, op)
+	c.journal.lock.Unlock()
+	return len(b), nil
+}
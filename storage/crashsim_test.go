@@ -0,0 +1,156 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCrashSim(t *testing.T) {
+	c := NewCrashSim("test", []byte{1, 2, 3}, nil)
+	p := NewCrashSim("peer", nil, c)
+	b := make([]byte, 1024)
+	for i := range b {
+		b[i] = byte(i) | 1
+	}
+
+	if n, err := c.WriteAt(b, 256); n != len(b) { // op 0
+		t.Fatal(10, n, err)
+	}
+
+	if n, err := p.WriteAt([]byte{4}, 0); n != 1 { // op 1
+		t.Fatal(20, n, err)
+	}
+
+	if err := c.Sync(); err != nil { // op 2
+		t.Fatal(30, err)
+	}
+
+	if err := c.Truncate(2); err != nil { // op 3
+		t.Fatal(40, err)
+	}
+
+	if g, e := c.Ops(), 4; g != e {
+		t.Fatal(50, g, e)
+	}
+
+	if g, e := c.Sectors(0), 3; g != e {
+		t.Fatal(60, g, e)
+	}
+
+	if g, e := c.Sectors(1), 0; g != e {
+		t.Fatal(70, g, e)
+	}
+
+	if g, e := p.Sectors(1), 1; g != e {
+		t.Fatal(80, g, e)
+	}
+
+	if g, e := c.Image(0, 0), []byte{1, 2, 3}; !bytes.Equal(g, e) {
+		t.Fatal(90, g, e)
+	}
+
+	for sectors, e := range []int{3, 512, 1024, 1280, 1280} {
+		img := c.Image(0, sectors)
+		if g := len(img); g != e {
+			t.Fatal(100, sectors, g, e)
+		}
+
+		if len(img) > 3 && !bytes.Equal(img[256:], b[:len(img)-256]) {
+			t.Fatal(110, sectors)
+		}
+	}
+
+	if g, e := p.Image(1, 0), []byte(nil); !bytes.Equal(g, e) {
+		t.Fatal(120, g, e)
+	}
+
+	if g, e := p.Image(2, 0), []byte{4}; !bytes.Equal(g, e) {
+		t.Fatal(130, g, e)
+	}
+
+	if g, e := len(c.SyncedImage(2)), 3; g != e {
+		t.Fatal(140, g, e)
+	}
+
+	if g, e := len(c.SyncedImage(3)), 1280; g != e {
+		t.Fatal(150, g, e)
+	}
+
+	if g, e := len(p.SyncedImage(4)), 0; g != e {
+		t.Fatal(160, g, e)
+	}
+
+	if g, e := c.Image(4, 0), []byte{1, 2}; !bytes.Equal(g, e) {
+		t.Fatal(170, g, e)
+	}
+
+	d := c.Crash(3, 0)
+	if g, e := d.Ops(), 0; g != e {
+		t.Fatal(180, g, e)
+	}
+
+	fi, err := d.Stat()
+	if err != nil {
+		t.Fatal(190, err)
+	}
+
+	if g, e := fi.Size(), int64(1280); g != e {
+		t.Fatal(200, g, e)
+	}
+}
+
+// Check that a WAL recovers to either the old or the new state after a crash
+// at any write, including torn ones.
+func TestWALCrash(t *testing.T) {
+	old := []byte("0123456789")
+	store := NewCrashSim("store", old, nil)
+	log := NewCrashSim("log", nil, store)
+	w, err := NewWAL(store, log)
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	b := bytes.Repeat([]byte("abcdefgh"), 200)
+	if err := Mutate(w, func() (err error) {
+		if _, err = w.WriteAt(b, 5); err != nil {
+			return
+		}
+
+		if err = w.Truncate(1000); err != nil {
+			return
+		}
+
+		_, err = w.WriteAt([]byte("xyz"), 1)
+		return
+	}); err != nil {
+		t.Fatal(20, err)
+	}
+
+	new := append([]byte("0xyz4"), b...)[:1000]
+	if g, e := store.Image(store.Ops(), 0), new; !bytes.Equal(g, e) {
+		t.Fatal(30, len(g), len(e))
+	}
+
+	for i := 0; i <= store.Ops(); i++ {
+		n := store.Sectors(i) + log.Sectors(i)
+		for sectors := 0; sectors <= n; sectors++ {
+			s, l := store.Crash(i, sectors), log.Crash(i, sectors)
+			w, err := NewWAL(s, l)
+			if err != nil {
+				t.Fatal(40, i, sectors, err)
+			}
+
+			if g := s.Image(s.Ops(), 0); !bytes.Equal(g, old) && !bytes.Equal(g, new) {
+				t.Fatal(50, i, sectors, len(g))
+			}
+
+			if err := w.Close(); err != nil {
+				t.Fatal(60, i, sectors, err)
+			}
+		}
+	}
+}
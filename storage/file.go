@@ -8,6 +8,8 @@ package storage
 
 import (
 	"os"
+
+	"github.com/cznic/fileutil"
 )
 
 // FileAccessor is the concrete type returned by NewFile and OpenFile.
@@ -21,6 +23,26 @@ func (f *FileAccessor) BeginUpdate() error { return nil }
 // Implementation of Accessor.
 func (f *FileAccessor) EndUpdate() error { return nil }
 
+// PunchHole implements PunchHoler using fileutil.PunchHole.
+func (f *FileAccessor) PunchHole(off, size int64) error {
+	return fileutil.PunchHole(f.File, off, size)
+}
+
+// Preallocate implements Preallocator using fileutil.Preallocate.
+func (f *FileAccessor) Preallocate(off, size int64) error {
+	return fileutil.Preallocate(f.File, off, size)
+}
+
+// TryLock implements FileLocker using fileutil.TryLock.
+func (f *FileAccessor) TryLock(mode fileutil.LockMode) error {
+	return fileutil.TryLock(f.File, mode)
+}
+
+// Unlock implements FileLocker using fileutil.Unlock.
+func (f *FileAccessor) Unlock() error {
+	return fileutil.Unlock(f.File)
+}
+
 // NewFile returns an Accessor backed by an os.File named name, It opens the
 // named file with specified flag (os.O_RDWR etc.) and perm, (0666 etc.) if
 // applicable.  If successful, methods on the returned Accessor can be used for
@@ -16,16 +16,97 @@ import (
 
 //TODO -> exported type w/ exported fields
 type memaccessor struct {
-	f  *os.File
-	fi *FileInfo
-	b  []byte
+	f      *os.File
+	fi     *FileInfo
+	b      []byte
+	failed bool // a nested update was rolled back
+	nest   int
+	undo   []memundo
+}
+
+// memundo records the state of memaccessor.b[off:size] before a WriteAt or
+// Truncate performed in an update.
+type memundo struct {
+	off  int
+	b    []byte
+	size int
 }
 
 // Implementation of Accessor.
-func (m *memaccessor) BeginUpdate() error { return nil }
+func (a *memaccessor) BeginUpdate() error {
+	a.nest++
+	return nil
+}
 
 // Implementation of Accessor.
-func (f *memaccessor) EndUpdate() error { return nil }
+func (a *memaccessor) EndUpdate() error {
+	return a.end(false)
+}
+
+// Implementation of Rollbacker.
+func (a *memaccessor) Rollback() error {
+	return a.end(true)
+}
+
+func (a *memaccessor) end(rollback bool) (err error) {
+	if a.nest == 0 {
+		return errors.New("update not in progress")
+	}
+
+	a.failed = a.failed || rollback
+	if a.nest--; a.nest != 0 {
+		return
+	}
+
+	if a.failed {
+		for i := len(a.undo) - 1; i >= 0; i-- {
+			u := a.undo[i]
+			if a.resize(u.size); len(u.b) != 0 {
+				copy(a.b[u.off:], u.b)
+			}
+		}
+		if !rollback {
+			err = ErrRolledBack
+		}
+	}
+	a.failed = false
+	a.undo = nil
+	return
+}
+
+// save records the content of a.b in [off, off+n) for a rollback.
+func (a *memaccessor) save(off, n int) {
+	if a.nest == 0 {
+		return
+	}
+
+	u := memundo{off: off, size: len(a.b)}
+	if off < u.size {
+		end := off + n
+		if end > u.size {
+			end = u.size
+		}
+		u.b = append([]byte(nil), a.b[off:end]...)
+	}
+	a.undo = append(a.undo, u)
+}
+
+// resize sets the length of a.b to size, zero filling any extension.
+func (a *memaccessor) resize(size int) {
+	switch n := len(a.b); {
+	case size <= n:
+		a.b = a.b[:size]
+	case size <= cap(a.b):
+		a.b = a.b[:size]
+		for i := n; i < size; i++ {
+			a.b[i] = 0
+		}
+	default:
+		nb := make([]byte, size, 2*size)
+		copy(nb, a.b)
+		a.b = nb
+	}
+}
 
 // NewMem returns a new Accessor backed by an os.File.  The returned Accessor
 // keeps all of the store content in memory.  The memory and file images are
@@ -33,7 +114,9 @@ func (f *memaccessor) EndUpdate() error { return nil }
 // and content which may be lost on process kill/crash.  NewMem return the
 // Accessor or an error of any.
 //
-// NOTE: The returned Accessor implements BeginUpdate and EndUpdate as a no op.
+// The returned Accessor implements Rollbacker. Updates are discarded on
+// Rollback by undoing the changes made to the memory image since the outermost
+// BeginUpdate.
 func NewMem(f *os.File) (store Accessor, err error) {
 	a := &memaccessor{f: f}
 	if err = f.Truncate(0); err != nil {
@@ -56,7 +139,7 @@ func NewMem(f *os.File) (store Accessor, err error) {
 // Recomended for small amounts of data only and content which may be lost on
 // process kill/crash.  OpenMem return the Accessor or an error of any.
 //
-// NOTE: The returned Accessor implements BeginUpdate and EndUpdate as a no op.
+// The returned Accessor implements Rollbacker, see NewMem.
 func OpenMem(f *os.File) (store Accessor, err error) {
 	a := &memaccessor{f: f}
 	if a.b, err = ioutil.ReadAll(a.f); err != nil {
@@ -104,8 +187,7 @@ func (a *memaccessor) ReadAt(b []byte, off int64) (n int, err error) {
 		return -1, fmt.Errorf("ReadAt: illegal rq %#x @ offset %#x, len %#x", rq, fp, len(a.b))
 	}
 
-	copy(b, a.b[fp:])
-	return
+	return copy(b, a.b[fp:]), nil
 }
 
 func (a *memaccessor) Stat() (fi os.FileInfo, err error) {
@@ -126,17 +208,16 @@ func (a *memaccessor) Sync() (err error) {
 }
 
 func (a *memaccessor) Truncate(size int64) (err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			err = e.(error)
-		}
-	}()
-
-	if size > math.MaxInt32 {
-		panic(errors.New("truncate: illegal size"))
+	if size < 0 || size > math.MaxInt32 {
+		return errors.New("truncate: illegal size")
 	}
 
-	a.b = a.b[:int(size)]
+	if n := int(size); n < len(a.b) {
+		a.save(n, len(a.b)-n)
+	} else {
+		a.save(len(a.b), 0)
+	}
+	a.resize(int(size))
 	return
 }
 
@@ -145,17 +226,48 @@ func (a *memaccessor) WriteAt(b []byte, off int64) (n int, err error) {
 		return -1, errors.New("WriteAt: illegal offset")
 	}
 
-	rq, fp, size := len(b), int(off), len(a.b)
-	if need := rq + fp; need > size {
-		if need <= cap(a.b) {
-			a.b = a.b[:need]
-		} else {
-			nb := make([]byte, need, 2*need)
-			copy(nb, a.b)
-			a.b = nb
-		}
+	rq, fp := len(b), int(off)
+	a.save(fp, rq)
+	if need := rq + fp; need > len(a.b) {
+		a.resize(need)
+	}
+
+	return copy(a.b[fp:], b), nil
+}
+
+// PunchHole implements PunchHoler. The part of the range within the store size
+// is zeroed.
+func (a *memaccessor) PunchHole(off, size int64) (err error) {
+	if off < 0 || size < 0 {
+		return errors.New("PunchHole: illegal range")
 	}
 
-	copy(a.b[int(off):], b)
+	if off >= int64(len(a.b)) {
+		return
+	}
+
+	if end := int64(len(a.b)); off+size > end {
+		size = end - off
+	}
+	fp, n := int(off), int(size)
+	a.save(fp, n)
+	for i := range a.b[fp : fp+n] {
+		a.b[fp+i] = 0
+	}
+	return
+}
+
+// Preallocate implements Preallocator. The capacity of the memory image is
+// grown to cover the range.
+func (a *memaccessor) Preallocate(off, size int64) (err error) {
+	if off < 0 || size < 0 || off+size > math.MaxInt32 {
+		return errors.New("Preallocate: illegal range")
+	}
+
+	if need := int(off + size); need > cap(a.b) {
+		nb := make([]byte, len(a.b), need)
+		copy(nb, a.b)
+		a.b = nb
+	}
 	return
 }
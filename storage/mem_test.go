@@ -7,9 +7,158 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func Test(t *testing.T) {
 	t.Log("TODO placeholder") //TODO
 }
+
+func TestMemRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-storage-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, "test.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMem(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if n, err := m.WriteAt([]byte{1, 2, 3, 4}, 0); n != 4 {
+		t.Fatal(10, n, err)
+	}
+
+	e := errors.New("fail")
+	if err := Mutate(m, func() error {
+		if n, err := m.WriteAt([]byte{5, 6, 7}, 2); n != 3 {
+			t.Fatal(20, n, err)
+		}
+
+		if err := m.Truncate(1); err != nil {
+			t.Fatal(30, err)
+		}
+
+		if n, err := m.WriteAt([]byte{8}, 8); n != 1 {
+			t.Fatal(40, n, err)
+		}
+
+		return e
+	}); err != e {
+		t.Fatal(50, err, e)
+	}
+
+	fi, err := m.Stat()
+	if err != nil {
+		t.Fatal(60, err)
+	}
+
+	if g, e := fi.Size(), int64(4); g != e {
+		t.Fatal(70, g, e)
+	}
+
+	b := make([]byte, 4)
+	if n, err := m.ReadAt(b, 0); n != 4 {
+		t.Fatal(80, n, err)
+	}
+
+	if g, e := b, []byte{1, 2, 3, 4}; !bytes.Equal(g, e) {
+		t.Fatal(90, g, e)
+	}
+
+	// A nested rollback dooms the outermost update.
+	if err := Mutate(m, func() error {
+		if n, err := m.WriteAt([]byte{9}, 0); n != 1 {
+			t.Fatal(100, n, err)
+		}
+
+		Mutate(m, func() error { return e })
+		return nil
+	}); err != ErrRolledBack {
+		t.Fatal(110, err, ErrRolledBack)
+	}
+
+	if n, err := m.ReadAt(b, 0); n != 4 {
+		t.Fatal(120, n, err)
+	}
+
+	if g, e := b, []byte{1, 2, 3, 4}; !bytes.Equal(g, e) {
+		t.Fatal(130, g, e)
+	}
+}
+
+func TestMemPunchHole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-storage-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, "test.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMem(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if n, err := m.WriteAt([]byte{1, 2, 3, 4}, 0); n != 4 {
+		t.Fatal(10, n, err)
+	}
+
+	e := errors.New("fail")
+	if err := Mutate(m, func() error {
+		if err := PunchHole(m, 1, 2); err != nil {
+			t.Fatal(20, err)
+		}
+
+		return e
+	}); err != e {
+		t.Fatal(30, err, e)
+	}
+
+	if err := PunchHole(m, 2, 10); err != nil {
+		t.Fatal(40, err)
+	}
+
+	if err := Preallocate(m, 0, 1<<10); err != nil {
+		t.Fatal(50, err)
+	}
+
+	fi, err := m.Stat()
+	if err != nil {
+		t.Fatal(60, err)
+	}
+
+	if g, e := fi.Size(), int64(4); g != e {
+		t.Fatal(70, g, e)
+	}
+
+	b := make([]byte, 4)
+	if n, err := m.ReadAt(b, 0); n != 4 {
+		t.Fatal(80, n, err)
+	}
+
+	if g, e := b, []byte{1, 2, 0, 0}; !bytes.Equal(g, e) {
+		t.Fatal(90, g, e)
+	}
+}
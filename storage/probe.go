@@ -6,7 +6,11 @@
 
 package storage
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+
+	"github.com/cznic/fileutil"
+)
 
 // Probe collects usage statistics of the embeded Accessor.
 // Probe itself IS an Accessor.
@@ -72,3 +76,23 @@ func (p *Probe) WriteAt(b []byte, off int64) (n int, err error) {
 	atomic.AddInt64(&p.SectorsWr, sectorLast-sectorFirst+1)
 	return
 }
+
+// PunchHole implements PunchHoler by forwarding to the embeded Accessor.
+func (p *Probe) PunchHole(off, size int64) error {
+	return PunchHole(p.Accessor, off, size)
+}
+
+// Preallocate implements Preallocator by forwarding to the embeded Accessor.
+func (p *Probe) Preallocate(off, size int64) error {
+	return Preallocate(p.Accessor, off, size)
+}
+
+// TryLock implements FileLocker by forwarding to the embeded Accessor.
+func (p *Probe) TryLock(mode fileutil.LockMode) error {
+	return TryLock(p.Accessor, mode)
+}
+
+// Unlock implements FileLocker by forwarding to the embeded Accessor.
+func (p *Probe) Unlock() error {
+	return Unlock(p.Accessor)
+}
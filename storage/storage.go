@@ -8,9 +8,12 @@
 package storage
 
 import (
+	"errors"
 	"os"
 	"sync"
 	"time"
+
+	"github.com/cznic/fileutil"
 )
 
 // FileInfo is a type implementing os.FileInfo which has setable fields, like
@@ -104,20 +107,124 @@ type Accessor interface {
 	EndUpdate() error
 }
 
+// Rollbacker is an optional interface implemented by Accessors which are able
+// to discard updates. Rollback ends an update like EndUpdate does, but the
+// outermost update is then discarded instead of committed. Rolling back a
+// nested update dooms the whole outermost update, in which case its final
+// EndUpdate discards it as well and returns ErrRolledBack.
+type Rollbacker interface {
+	Rollback() error
+}
+
+// PunchHoler is an optional interface implemented by Accessors able to
+// deallocate the physical space of a byte range of the store. The size of the
+// store doesn't change, reading the range afterwards returns zeros. PunchHole
+// must not be invoked while an update is in progress.
+type PunchHoler interface {
+	PunchHole(off, size int64) error
+}
+
+// Preallocator is an optional interface implemented by Accessors able to
+// allocate the physical space of a byte range of the store in advance. The
+// size of the store doesn't change.
+type Preallocator interface {
+	Preallocate(off, size int64) error
+}
+
+// PunchHole deallocates the byte range of a if a is a PunchHoler. Otherwise
+// the part of the range within the store size is overwritten with zeros.
+func PunchHole(a Accessor, off, size int64) (err error) {
+	if p, ok := a.(PunchHoler); ok {
+		return p.PunchHole(off, size)
+	}
+
+	fi, err := a.Stat()
+	if err != nil {
+		return
+	}
+
+	if end := fi.Size(); off+size > end {
+		size = end - off
+	}
+	b := make([]byte, 1<<16)
+	for size > 0 {
+		if size < int64(len(b)) {
+			b = b[:size]
+		}
+		if _, err = a.WriteAt(b, off); err != nil {
+			return
+		}
+
+		off += int64(len(b))
+		size -= int64(len(b))
+	}
+	return
+}
+
+// Preallocate allocates the byte range of a in advance if a is a
+// Preallocator. Otherwise Preallocate is a no op.
+func Preallocate(a Accessor, off, size int64) error {
+	if p, ok := a.(Preallocator); ok {
+		return p.Preallocate(off, size)
+	}
+
+	return nil
+}
+
+// FileLocker is an optional interface implemented by Accessors backed by a
+// file which other processes may access. TryLock locks the whole store in mode
+// or returns fileutil.ErrLocked if a conflicting lock is held. The lock is
+// released by Unlock or by closing the store.
+type FileLocker interface {
+	TryLock(mode fileutil.LockMode) error
+	Unlock() error
+}
+
+// TryLock locks a in mode if a is a FileLocker. Otherwise TryLock is a no op,
+// other processes cannot access a.
+func TryLock(a Accessor, mode fileutil.LockMode) error {
+	if l, ok := a.(FileLocker); ok {
+		return l.TryLock(mode)
+	}
+
+	return nil
+}
+
+// Unlock unlocks a if a is a FileLocker. Otherwise Unlock is a no op.
+func Unlock(a Accessor) error {
+	if l, ok := a.(FileLocker); ok {
+		return l.Unlock()
+	}
+
+	return nil
+}
+
+// ErrRolledBack is returned by EndUpdate of a Rollbacker if the update was
+// discarded because some of the nested updates were rolled back.
+var ErrRolledBack = errors.New("update rolled back")
+
 // Mutate is a helper/wrapper for executing f in between a.BeginUpdate and
 // a.EndUpdate.  Any parameters and/or return values except an error should be
 // captured by a function literal passed as f. The returned err is either nil
 // or the first non nil error returned from the sequence of execution:
 // BeginUpdate, [f,] EndUpdate. The pair BeginUpdate/EndUpdate *is* invoked
-// always regardles of any possible errors produced.  Mutate doesn't handle
-// panic, it should be used only with a function [literal] which doesn't panic.
-// Otherwise the pairing of BeginUpdate/EndUpdate is not guaranteed.
+// always regardles of any possible errors produced, even if f panics.
+//
+// If a implements Rollbacker and BeginUpdate or f fails, i.e. returns an
+// error or panics, then a.Rollback is invoked instead of a.EndUpdate.
 //
 // NOTE: If BeginUpdate, which is invoked before f, returns a non-nil error,
-// then f is not invoked at all (but EndUpdate still is).
+// then f is not invoked at all (but EndUpdate or Rollback still is).
 func Mutate(a Accessor, f func() error) (err error) {
+	ok := false
 	defer func() {
-		if e := a.EndUpdate(); e != nil && err == nil {
+		var e error
+		if r, isRollbacker := a.(Rollbacker); isRollbacker && !ok {
+			e = r.Rollback()
+		} else {
+			e = a.EndUpdate()
+		}
+		if e != nil && err == nil {
 			err = e
 		}
 	}()
@@ -126,13 +233,14 @@ func Mutate(a Accessor, f func() error) (err error) {
 		return
 	}
 
-	return f()
+	err = f()
+	ok = err == nil
+	return
 }
 
 // LockedMutate wraps Mutate in yet another layer consisting of a
-// l.Lock/l.Unlock pair. All other limitations apply as in Mutate, e.g. no
-// panics are allowed to happen - otherwise no guarantees can be made about
-// Unlock matching the Lock.
+// l.Lock/l.Unlock pair. All other properties are as in Mutate, including the
+// Lock/Unlock pairing being preserved when f panics.
 func LockedMutate(a Accessor, l sync.Locker, f func() error) (err error) {
 	l.Lock()
 	defer l.Unlock()
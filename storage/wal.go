@@ -0,0 +1,545 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/cznic/fileutil"
+)
+
+/*
+
+WAL log layout
+
+The log holds at most one transaction. Between transactions the log is empty.
+All integers are in network byte order.
+
+ +-------+------+-----+------+
+ | magic | op 1 | ... | op n | commit
+ +-------+------+-----+------+
+
+magic is the 8 byte walMagic.
+
+op is either a write or a truncate:
+
+ +------+---------+---------+----------+
+ | 0x01 | off (8) | len (4) | len data |
+ +------+---------+---------+----------+
+
+ +------+----------+
+ | 0x02 | size (8) |
+ +------+----------+
+
+commit is
+
+ +------+---------+
+ | 0xFF | crc (4) |
+ +------+---------+
+
+where crc is the Castagnoli CRC-32 of all the preceding bytes of the log. A
+log not ending with a valid commit record is an incomplete transaction and is
+discarded on open.
+
+*/
+
+const (
+	walWrite    = 0x01
+	walTruncate = 0x02
+	walCommit   = 0xff
+)
+
+var (
+	walMagic = []byte{0xf1, 'W', 'A', 'L', 0, 0, 0, 1}
+	walCRC   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type walop struct {
+	off int64  // write offset or truncate size
+	b   []byte // nil for truncate
+}
+
+// WAL is an Accessor providing atomic updates of another Accessor using a
+// write-ahead log.
+//
+// WriteAt and Truncate issued between the outermost BeginUpdate and the
+// matching EndUpdate are only buffered in memory. The last EndUpdate writes
+// them to the log, syncs the log, applies them to the store, syncs the store
+// and finally empties the log. A crash at any point leaves either the old or
+// the new store state after the WAL is reopened by NewWAL.
+//
+// WriteAt and Truncate invoked outside of BeginUpdate/EndUpdate are each
+// committed as a separate transaction.
+//
+// If applying a logged transaction to the store fails, the WAL fails all
+// subsequent BeginUpdate, WriteAt, Truncate and ReadAt calls. The store and the
+// log must then be closed and reopened by NewWAL, which completes the
+// transaction.
+//
+// WAL implements Rollbacker.
+type WAL struct {
+	err    error // sticky, applying a transaction failed
+	f      Accessor
+	failed bool // a nested update was rolled back
+	fi     *FileInfo
+	lock   sync.Mutex
+	log    Accessor
+	nest   int
+	ops    []walop
+	size   int64 // store size as seen through the WAL
+	size0  int64 // store size when the current transaction started
+}
+
+// NewWAL returns a WAL providing atomic updates of store using log for
+// keeping the write-ahead log. If log contains a complete transaction it is
+// applied to store first, an incomplete one is discarded.  NewWAL returns the
+// WAL or an error, if any.
+func NewWAL(store, log Accessor) (w *WAL, err error) {
+	w = &WAL{f: store, log: log}
+	if err = w.recover(); err != nil {
+		return nil, err
+	}
+
+	var fi os.FileInfo
+	if fi, err = store.Stat(); err != nil {
+		return nil, err
+	}
+
+	w.fi = NewFileInfo(fi, w)
+	w.size = fi.Size()
+	return
+}
+
+// Accessor returns the store Accessor of w.
+func (w *WAL) Accessor() Accessor {
+	return w.f
+}
+
+// Log returns the log Accessor of w.
+func (w *WAL) Log() Accessor {
+	return w.log
+}
+
+func (w *WAL) recover() (err error) {
+	fi, err := w.log.Stat()
+	if err != nil {
+		return
+	}
+
+	if fi.Size() == 0 {
+		return
+	}
+
+	b := make([]byte, fi.Size())
+	if n, e := w.log.ReadAt(b, 0); n != len(b) {
+		if err = e; err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	if ops, ok := walDecode(b); ok {
+		if err = w.apply(ops); err != nil {
+			return
+		}
+	}
+
+	return w.reset()
+}
+
+// walEncode returns the log image of a transaction consisting of ops.
+func walEncode(ops []walop) []byte {
+	n := len(walMagic) + 5
+	for _, op := range ops {
+		n += 9
+		if op.b != nil {
+			n += 4 + len(op.b)
+		}
+	}
+
+	b := make([]byte, 0, n)
+	b = append(b, walMagic...)
+	var buf [12]byte
+	for _, op := range ops {
+		binary.BigEndian.PutUint64(buf[:], uint64(op.off))
+		if op.b == nil {
+			b = append(b, walTruncate)
+			b = append(b, buf[:8]...)
+			continue
+		}
+
+		binary.BigEndian.PutUint32(buf[8:], uint32(len(op.b)))
+		b = append(b, walWrite)
+		b = append(b, buf[:12]...)
+		b = append(b, op.b...)
+	}
+	b = append(b, walCommit)
+	binary.BigEndian.PutUint32(buf[:], crc32.Checksum(b, walCRC))
+	return append(b, buf[:4]...)
+}
+
+// walDecode returns the ops of a transaction logged in b and whether b is a
+// complete transaction.
+func walDecode(b []byte) (ops []walop, ok bool) {
+	if len(b) < len(walMagic)+5 || string(b[:len(walMagic)]) != string(walMagic) {
+		return
+	}
+
+	n := len(b) - 4
+	if b[n-1] != walCommit || binary.BigEndian.Uint32(b[n:]) != crc32.Checksum(b[:n], walCRC) {
+		return
+	}
+
+	for p := b[len(walMagic) : n-1]; len(p) != 0; {
+		switch p[0] {
+		case walWrite:
+			if len(p) < 13 {
+				return nil, false
+			}
+
+			off, n := int64(binary.BigEndian.Uint64(p[1:])), int(binary.BigEndian.Uint32(p[9:]))
+			if off < 0 || n > len(p)-13 {
+				return nil, false
+			}
+
+			ops = append(ops, walop{off, p[13 : 13+n]})
+			p = p[13+n:]
+		case walTruncate:
+			if len(p) < 9 {
+				return nil, false
+			}
+
+			off := int64(binary.BigEndian.Uint64(p[1:]))
+			if off < 0 {
+				return nil, false
+			}
+
+			ops = append(ops, walop{off: off})
+			p = p[9:]
+		default:
+			return nil, false
+		}
+	}
+	return ops, true
+}
+
+// apply performs ops on the store and syncs it.
+func (w *WAL) apply(ops []walop) (err error) {
+	for _, op := range ops {
+		if op.b == nil {
+			if err = w.f.Truncate(op.off); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		if n, err := w.f.WriteAt(op.b, op.off); n != len(op.b) {
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+			return err
+		}
+	}
+	return w.f.Sync()
+}
+
+// reset empties the log.
+func (w *WAL) reset() (err error) {
+	if err = w.log.Truncate(0); err != nil {
+		return
+	}
+
+	return w.log.Sync()
+}
+
+// commit writes the buffered ops to the log, applies them to the store and
+// empties the log. The caller holds w.lock.
+func (w *WAL) commit() (err error) {
+	ops := w.ops
+	w.ops = nil
+	if len(ops) == 0 {
+		return
+	}
+
+	b := walEncode(ops)
+	if n, err := w.log.WriteAt(b, 0); n != len(b) {
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		w.size = w.size0
+		w.reset()
+		return fmt.Errorf("WAL %s: %s", w.log.Name(), err)
+	}
+
+	// Drop any stale tail, a longer log would fail its CRC check.
+	if err = w.log.Truncate(int64(len(b))); err == nil {
+		err = w.log.Sync()
+	}
+	if err != nil {
+		w.size = w.size0
+		return fmt.Errorf("WAL %s: %s", w.log.Name(), err)
+	}
+
+	// From now on the transaction is durable. If applying it fails the
+	// log is left as is and the transaction gets replayed by NewWAL. Until
+	// then the store is half updated and w refuses to touch it.
+	if err = w.apply(ops); err != nil {
+		w.err = fmt.Errorf("WAL %s: transaction not applied, reopen to recover: %s", w.Name(), err)
+		return
+	}
+
+	return w.reset()
+}
+
+// BeginUpdate implements Accessor.
+func (w *WAL) BeginUpdate() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.nest == 0 {
+		w.size0 = w.size
+	}
+	w.nest++
+	return nil
+}
+
+// EndUpdate implements Accessor. The last nested EndUpdate commits the
+// transaction.
+func (w *WAL) EndUpdate() (err error) {
+	return w.end(false)
+}
+
+// Rollback implements Rollbacker. The last nested Rollback discards the
+// transaction.
+func (w *WAL) Rollback() (err error) {
+	return w.end(true)
+}
+
+func (w *WAL) end(rollback bool) (err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.nest == 0 {
+		return fmt.Errorf("WAL %s: update not in progress", w.Name())
+	}
+
+	w.failed = w.failed || rollback
+	if w.nest--; w.nest != 0 {
+		return
+	}
+
+	if w.failed {
+		w.failed = false
+		w.ops = nil
+		w.size = w.size0
+		if !rollback {
+			err = ErrRolledBack
+		}
+		return
+	}
+
+	return w.commit()
+}
+
+// Close closes both the store and the log. An update still in progress is
+// discarded and Close returns ErrRolledBack.
+func (w *WAL) Close() (err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.nest != 0 {
+		w.nest, w.failed, w.ops = 0, false, nil
+		w.size = w.size0
+		err = ErrRolledBack
+	}
+	if e := w.f.Close(); e != nil && err == nil {
+		err = e
+	}
+	if e := w.log.Close(); e != nil && err == nil {
+		err = e
+	}
+	return
+}
+
+// Name implements Accessor.
+func (w *WAL) Name() string {
+	return w.f.Name()
+}
+
+// ReadAt implements Accessor. Data written by not yet committed updates are
+// visible to ReadAt.
+func (w *WAL) ReadAt(b []byte, off int64) (n int, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if len(w.ops) == 0 {
+		return w.f.ReadAt(b, off)
+	}
+
+	if off < 0 {
+		return 0, fmt.Errorf("WAL %s: ReadAt: illegal offset %#x", w.Name(), off)
+	}
+
+	if n = len(b); off+int64(n) > w.size {
+		if n = int(w.size - off); n < 0 {
+			n = 0
+		}
+		err = io.EOF
+	}
+	p := b[:n]
+	m := w.size0 - off
+	switch {
+	case m < 0:
+		m = 0
+	case m > int64(n):
+		m = int64(n)
+	}
+	if m != 0 {
+		if k, e := w.f.ReadAt(p[:m], off); k != int(m) {
+			if e == nil {
+				e = io.ErrUnexpectedEOF
+			}
+			return k, e
+		}
+	}
+	for i := m; i < int64(n); i++ {
+		p[i] = 0
+	}
+	for _, op := range w.ops {
+		overlay(p, off, op)
+	}
+	return
+}
+
+// overlay applies op to b holding the content at offset off.
+func overlay(b []byte, off int64, op walop) {
+	end := off + int64(len(b))
+	if op.b == nil { // truncate
+		if op.off < end {
+			from := op.off - off
+			if from < 0 {
+				from = 0
+			}
+			for i := from; i < int64(len(b)); i++ {
+				b[i] = 0
+			}
+		}
+		return
+	}
+
+	opend := op.off + int64(len(op.b))
+	if opend <= off || op.off >= end {
+		return
+	}
+
+	if op.off >= off {
+		copy(b[op.off-off:], op.b)
+		return
+	}
+
+	copy(b, op.b[off-op.off:])
+}
+
+// Stat implements Accessor. The size reported includes not yet committed
+// updates.
+func (w *WAL) Stat() (fi os.FileInfo, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.fi.FSize = w.size
+	return w.fi, nil
+}
+
+// Sync implements Accessor. Only the committed state of the store is synced.
+func (w *WAL) Sync() (err error) {
+	return w.f.Sync()
+}
+
+// Truncate implements Accessor.
+func (w *WAL) Truncate(size int64) (err error) {
+	if size < 0 {
+		return fmt.Errorf("WAL %s: Truncate: illegal size %#x", w.Name(), size)
+	}
+
+	return w.update(func() {
+		w.ops = append(w.ops, walop{off: size})
+		w.size = size
+	})
+}
+
+// PunchHole implements PunchHoler. The range is punched directly in the store,
+// thus PunchHole fails if an update is in progress.
+func (w *WAL) PunchHole(off, size int64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.nest != 0 {
+		return fmt.Errorf("WAL %s: PunchHole: update in progress", w.Name())
+	}
+
+	return PunchHole(w.f, off, size)
+}
+
+// Preallocate implements Preallocator.
+func (w *WAL) Preallocate(off, size int64) error {
+	return Preallocate(w.f, off, size)
+}
+
+// TryLock implements FileLocker by locking the store, the log is not locked.
+func (w *WAL) TryLock(mode fileutil.LockMode) error {
+	return TryLock(w.f, mode)
+}
+
+// Unlock implements FileLocker.
+func (w *WAL) Unlock() error {
+	return Unlock(w.f)
+}
+
+// WriteAt implements Accessor.
+func (w *WAL) WriteAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("WAL %s: WriteAt: illegal offset %#x", w.Name(), off)
+	}
+
+	if err = w.update(func() {
+		w.ops = append(w.ops, walop{off, append([]byte(nil), b...)})
+		if end := off + int64(len(b)); end > w.size {
+			w.size = end
+		}
+	}); err != nil {
+		return
+	}
+
+	return len(b), nil
+}
+
+// update executes f, which records an op, as a part of the current
+// transaction or as a separate transaction if there's none.
+func (w *WAL) update(f func()) (err error) {
+	w.lock.Lock()
+	if w.nest != 0 {
+		f()
+		w.lock.Unlock()
+		return
+	}
+
+	w.lock.Unlock()
+	if err = w.BeginUpdate(); err != nil {
+		return
+	}
+
+	w.lock.Lock()
+	f()
+	w.lock.Unlock()
+	return w.EndUpdate()
+}
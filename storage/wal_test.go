@@ -0,0 +1,374 @@
+// Copyright (c) 2014 The fileutil Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+func newwal(t *testing.T) (dir, name, logname string, w *WAL) {
+	dir, name, f := newfile(t)
+	logname = filepath.Join(dir, "test.log")
+	log, err := NewFile(logname, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal("newwal", err)
+	}
+
+	if w, err = NewWAL(f, log); err != nil {
+		t.Fatal("newwal", err)
+	}
+
+	return
+}
+
+func reopenwal(t *testing.T, name, logname string) *WAL {
+	f, err := OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal("reopenwal", err)
+	}
+
+	log, err := OpenFile(logname, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal("reopenwal", err)
+	}
+
+	w, err := NewWAL(f, log)
+	if err != nil {
+		t.Fatal("reopenwal", err)
+	}
+
+	return w
+}
+
+func TestWAL0(t *testing.T) {
+	dir, name, logname, w := newwal(t)
+	defer os.RemoveAll(dir)
+
+	if err := w.BeginUpdate(); err != nil {
+		t.Fatal(10, err)
+	}
+
+	if n, err := w.WriteAt([]byte{1, 2, 3, 4}, 0); n != 4 {
+		t.Fatal(20, n, err)
+	}
+
+	if err := w.Truncate(2); err != nil {
+		t.Fatal(30, err)
+	}
+
+	if n, err := w.WriteAt([]byte{5}, 3); n != 1 {
+		t.Fatal(40, n, err)
+	}
+
+	b := make([]byte, 4)
+	if n, err := w.ReadAt(b, 0); n != 4 {
+		t.Fatal(50, n, err)
+	}
+
+	if g, e := b, []byte{1, 2, 0, 5}; !bytes.Equal(g, e) {
+		t.Fatal(60, g, e)
+	}
+
+	if b := readfile(t, name); len(b) != 0 {
+		t.Fatal(70, len(b), 0)
+	}
+
+	if err := w.EndUpdate(); err != nil {
+		t.Fatal(80, err)
+	}
+
+	if g, e := readfile(t, name), []byte{1, 2, 0, 5}; !bytes.Equal(g, e) {
+		t.Fatal(90, g, e)
+	}
+
+	if b := readfile(t, logname); len(b) != 0 {
+		t.Fatal(100, len(b), 0)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(110, err)
+	}
+}
+
+func TestWALRecover(t *testing.T) {
+	dir, name, logname, w := newwal(t)
+	defer os.RemoveAll(dir)
+
+	if n, err := w.WriteAt([]byte{1, 2, 3}, 0); n != 3 {
+		t.Fatal(10, n, err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(20, err)
+	}
+
+	// A committed, but not yet applied transaction.
+	log := walEncode([]walop{{1, []byte{4, 5, 6}}, {off: 3}})
+	if err := ioutil.WriteFile(logname, log, 0666); err != nil {
+		t.Fatal(30, err)
+	}
+
+	w = reopenwal(t, name, logname)
+	if g, e := readfile(t, name), []byte{1, 4, 5}; !bytes.Equal(g, e) {
+		t.Fatal(40, g, e)
+	}
+
+	if b := readfile(t, logname); len(b) != 0 {
+		t.Fatal(50, len(b), 0)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(60, err)
+	}
+
+	// Incomplete transactions must be discarded.
+	for i := 0; i < len(log); i++ {
+		if err := ioutil.WriteFile(logname, log[:i], 0666); err != nil {
+			t.Fatal(70, err)
+		}
+
+		w = reopenwal(t, name, logname)
+		if g, e := readfile(t, name), []byte{1, 4, 5}; !bytes.Equal(g, e) {
+			t.Fatal(80, i, g, e)
+		}
+
+		if err := w.Close(); err != nil {
+			t.Fatal(90, err)
+		}
+	}
+
+	// So are damaged ones.
+	log[len(log)/2] ^= 0x55
+	if err := ioutil.WriteFile(logname, log, 0666); err != nil {
+		t.Fatal(100, err)
+	}
+
+	w = reopenwal(t, name, logname)
+	if g, e := readfile(t, name), []byte{1, 4, 5}; !bytes.Equal(g, e) {
+		t.Fatal(110, g, e)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(120, err)
+	}
+}
+
+func TestWALRollback(t *testing.T) {
+	dir, name, logname, w := newwal(t)
+	defer os.RemoveAll(dir)
+
+	if n, err := w.WriteAt([]byte{1, 2, 3}, 0); n != 3 {
+		t.Fatal(10, n, err)
+	}
+
+	e := errors.New("fail")
+	if err := Mutate(w, func() error {
+		if n, err := w.WriteAt([]byte{4, 5, 6, 7}, 1); n != 4 {
+			t.Fatal(20, n, err)
+		}
+
+		return e
+	}); err != e {
+		t.Fatal(30, err, e)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(40, err)
+	}
+
+	if g, e := readfile(t, name), []byte{1, 2, 3}; !bytes.Equal(g, e) {
+		t.Fatal(50, g, e)
+	}
+
+	if b := readfile(t, logname); len(b) != 0 {
+		t.Fatal(60, len(b), 0)
+	}
+}
+
+func TestWALPunchHole(t *testing.T) {
+	dir, name, _, w := newwal(t)
+	defer os.RemoveAll(dir)
+
+	b := bytes.Repeat([]byte{0xff}, 1<<14)
+	if n, err := w.WriteAt(b, 0); n != len(b) {
+		t.Fatal(10, n, err)
+	}
+
+	if err := w.BeginUpdate(); err != nil {
+		t.Fatal(20, err)
+	}
+
+	if err := w.PunchHole(1<<12, 1<<12); err == nil {
+		t.Fatal(30)
+	}
+
+	if err := w.EndUpdate(); err != nil {
+		t.Fatal(40, err)
+	}
+
+	if err := w.PunchHole(1<<12, 1<<12); err != nil {
+		t.Fatal(50, err)
+	}
+
+	g := readfile(t, name)
+	if len(g) != len(b) {
+		t.Fatal(60, len(g), len(b))
+	}
+
+	if runtime.GOOS == "linux" && runtime.GOARCH != "arm" {
+		for i := range b[1<<12 : 1<<13] {
+			b[1<<12+i] = 0
+		}
+	}
+	if !bytes.Equal(g, b) {
+		t.Fatal(70)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(80, err)
+	}
+}
+
+// shortAccessor returns short reads without an error.
+type shortAccessor struct {
+	Accessor
+}
+
+func (s shortAccessor) ReadAt(b []byte, off int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	return s.Accessor.ReadAt(b[:len(b)-1], off)
+}
+
+func TestWALShortLog(t *testing.T) {
+	dir, name, logname, w := newwal(t)
+	defer os.RemoveAll(dir)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(10, err)
+	}
+
+	if err := ioutil.WriteFile(logname, walEncode([]walop{{0, []byte{1}}}), 0666); err != nil {
+		t.Fatal(20, err)
+	}
+
+	f, err := OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(30, err)
+	}
+
+	defer f.Close()
+	log, err := OpenFile(logname, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(40, err)
+	}
+
+	defer log.Close()
+	if _, err := NewWAL(f, shortAccessor{log}); err != io.ErrUnexpectedEOF {
+		t.Fatal(50, err)
+	}
+}
+
+func TestWALApplyFail(t *testing.T) {
+	dir, name, logname, w := newwal(t)
+	defer os.RemoveAll(dir)
+
+	if n, err := w.WriteAt(bytes.Repeat([]byte{1}, 100), 0); n != 100 {
+		t.Fatal(10, n, err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(20, err)
+	}
+
+	f, err := OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(30, err)
+	}
+
+	log, err := OpenFile(logname, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(40, err)
+	}
+
+	fa := &failAccessor{Accessor: f}
+	if w, err = NewWAL(fa, log); err != nil {
+		t.Fatal(50, err)
+	}
+
+	// A stale tail of the log must not survive the next transaction.
+	if _, err = log.WriteAt(bytes.Repeat([]byte{0xa5}, 100), 1000); err != nil {
+		t.Fatal(60, err)
+	}
+
+	atomic.StoreInt32(&fa.wr, 1)
+	if _, err = w.WriteAt([]byte{2, 2}, 0); err != errFail {
+		t.Fatal(70, err)
+	}
+
+	// The WAL is failed until reopened.
+	atomic.StoreInt32(&fa.wr, 0)
+	if _, err = w.WriteAt([]byte{3}, 50); err == nil {
+		t.Fatal(80)
+	}
+
+	if err = w.BeginUpdate(); err == nil {
+		t.Fatal(90)
+	}
+
+	if _, err = w.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Fatal(100)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(110, err)
+	}
+
+	w = reopenwal(t, name, logname)
+	e := bytes.Repeat([]byte{1}, 100)
+	e[0], e[1] = 2, 2
+	if g := readfile(t, name); !bytes.Equal(g, e) {
+		t.Fatal(120, g, e)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(130, err)
+	}
+}
+
+func TestWALCloseInUpdate(t *testing.T) {
+	dir, name, _, w := newwal(t)
+	defer os.RemoveAll(dir)
+
+	if n, err := w.WriteAt([]byte{1, 2, 3}, 0); n != 3 {
+		t.Fatal(10, n, err)
+	}
+
+	if err := w.BeginUpdate(); err != nil {
+		t.Fatal(20, err)
+	}
+
+	if n, err := w.WriteAt([]byte{4, 5, 6, 7}, 1); n != 4 {
+		t.Fatal(30, n, err)
+	}
+
+	if err := w.Close(); err != ErrRolledBack {
+		t.Fatal(40, err)
+	}
+
+	if g, e := readfile(t, name), []byte{1, 2, 3}; !bytes.Equal(g, e) {
+		t.Fatal(50, g, e)
+	}
+}